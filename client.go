@@ -0,0 +1,167 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+// Doer is implemented by modbus masters (clients) that can issue a
+// request to a node (slave or unit) and return the unpacked
+// response. SerMaster, SerBus and TcpMaster implement Doer. See
+// SerMaster.Do for the semantics of the Do method.
+type Doer interface {
+	Do(node uint8, req Req, res Res) (Res, error)
+}
+
+// Client provides typed, high-level methods for the standard modbus
+// data-access functions. Addresses are zero-based (protocol
+// addresses). Exception responses from the node are returned as
+// errors (*ResExc). A Client is obtained by calling NewClient with any
+// Doer (modbus master), so code using a Client is
+// transport-agnostic.
+type Client interface {
+	// ReadCoils reads n coils starting at addr (fn: 0x01)
+	ReadCoils(node uint8, addr, n uint16) ([]bool, error)
+	// ReadDiscreteInputs reads n discrete inputs starting at
+	// addr (fn: 0x02)
+	ReadDiscreteInputs(node uint8, addr, n uint16) ([]bool, error)
+	// ReadHoldingRegisters reads n holding registers starting at
+	// addr (fn: 0x03)
+	ReadHoldingRegisters(node uint8, addr, n uint16) ([]uint16, error)
+	// ReadInputRegisters reads n input registers starting at
+	// addr (fn: 0x04)
+	ReadInputRegisters(node uint8, addr, n uint16) ([]uint16, error)
+	// WriteSingleCoil sets the coil at addr to v (fn: 0x05)
+	WriteSingleCoil(node uint8, addr uint16, v bool) error
+	// WriteSingleRegister sets the holding register at addr to v
+	// (fn: 0x06)
+	WriteSingleRegister(node uint8, addr uint16, v uint16) error
+	// WriteMultipleCoils sets len(v) coils, starting at addr, to
+	// the values in v (fn: 0x0f)
+	WriteMultipleCoils(node uint8, addr uint16, v []bool) error
+	// WriteMultipleRegisters sets len(v) holding registers,
+	// starting at addr, to the values in v (fn: 0x10)
+	WriteMultipleRegisters(node uint8, addr uint16, v []uint16) error
+	// MaskWriteRegister modifies the holding register at addr
+	// using the given AND and OR masks (fn: 0x16)
+	MaskWriteRegister(node uint8, addr, and, or uint16) error
+	// ReadWriteMultipleRegisters sets len(wv) holding registers,
+	// starting at wAddr, to the values in wv, and then reads rn
+	// holding registers starting at rAddr (fn: 0x17)
+	ReadWriteMultipleRegisters(node uint8, rAddr, rn uint16,
+		wAddr uint16, wv []uint16) ([]uint16, error)
+}
+
+// NewClient returns a Client that issues requests using d.
+func NewClient(d Doer) Client {
+	return &client{d: d}
+}
+
+type client struct {
+	d Doer
+}
+
+// unpackBits returns the first n bits of the packed bit-status bs as
+// a slice of bools.
+func unpackBits(bs []byte, n int) []bool {
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = bs[i>>3]&(1<<(uint(i)&7)) != 0
+	}
+	return v
+}
+
+// packBits packs the bools in v, one per bit, least-significant bit
+// first.
+func packBits(v []bool) []byte {
+	bs := make([]byte, (len(v)+7)/8)
+	for i, b := range v {
+		if b {
+			bs[i>>3] |= 1 << (uint(i) & 7)
+		}
+	}
+	return bs
+}
+
+func (c *client) readBits(node uint8, coils bool,
+	addr, n uint16) ([]bool, error) {
+	var res ResRdInputs
+	_, err := c.d.Do(node, &ReqRdInputs{Coils: coils, Addr: addr, Num: n}, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.BitStat) < (int(n)+7)/8 {
+		return nil, ErrResponse
+	}
+	return unpackBits(res.BitStat, int(n)), nil
+}
+
+func (c *client) ReadCoils(node uint8, addr, n uint16) ([]bool, error) {
+	return c.readBits(node, true, addr, n)
+}
+
+func (c *client) ReadDiscreteInputs(node uint8, addr, n uint16) ([]bool, error) {
+	return c.readBits(node, false, addr, n)
+}
+
+func (c *client) readRegs(node uint8, holding bool,
+	addr, n uint16) ([]uint16, error) {
+	var res ResRdRegs
+	_, err := c.d.Do(node, &ReqRdRegs{Holding: holding, Addr: addr, Num: n}, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Val) < int(n) {
+		return nil, ErrResponse
+	}
+	return res.Val[:n], nil
+}
+
+func (c *client) ReadHoldingRegisters(node uint8, addr, n uint16) ([]uint16, error) {
+	return c.readRegs(node, true, addr, n)
+}
+
+func (c *client) ReadInputRegisters(node uint8, addr, n uint16) ([]uint16, error) {
+	return c.readRegs(node, false, addr, n)
+}
+
+func (c *client) WriteSingleCoil(node uint8, addr uint16, v bool) error {
+	_, err := c.d.Do(node, &ReqResWrCoil{Addr: addr, Status: v}, nil)
+	return err
+}
+
+func (c *client) WriteSingleRegister(node uint8, addr uint16, v uint16) error {
+	_, err := c.d.Do(node, &ReqResWrReg{Addr: addr, Val: v}, nil)
+	return err
+}
+
+func (c *client) WriteMultipleCoils(node uint8, addr uint16, v []bool) error {
+	req := &ReqWrCoils{Addr: addr, Num: uint16(len(v)), BitStat: packBits(v)}
+	_, err := c.d.Do(node, req, nil)
+	return err
+}
+
+func (c *client) WriteMultipleRegisters(node uint8, addr uint16, v []uint16) error {
+	_, err := c.d.Do(node, &ReqWrRegs{Addr: addr, Val: v}, nil)
+	return err
+}
+
+func (c *client) MaskWriteRegister(node uint8, addr, and, or uint16) error {
+	req := &ReqResMskWrReg{Addr: addr, AndMsk: and, OrMsk: or}
+	_, err := c.d.Do(node, req, nil)
+	return err
+}
+
+func (c *client) ReadWriteMultipleRegisters(node uint8, rAddr, rn uint16,
+	wAddr uint16, wv []uint16) ([]uint16, error) {
+	var res ResRdWrRegs
+	req := &ReqRdWrRegs{RdAddr: rAddr, RdNum: rn, WrAddr: wAddr, WrVal: wv}
+	_, err := c.d.Do(node, req, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Val) < int(rn) {
+		return nil, ErrResponse
+	}
+	return res.Val[:rn], nil
+}
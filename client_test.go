@@ -0,0 +1,68 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	dev := &testDev{node: 0x05}
+	p := &testSerPort{reply: dev.reply}
+	c := NewClient(newTestSerMaster(p))
+
+	coils := []bool{true, false, true, true, false, false, true, false, true}
+	if err := c.WriteMultipleCoils(0x05, 10, coils); err != nil {
+		t.Fatalf("WriteMultipleCoils: %s", err)
+	}
+	if err := c.WriteSingleCoil(0x05, 11, true); err != nil {
+		t.Fatalf("WriteSingleCoil: %s", err)
+	}
+	coils[1] = true
+	v, err := c.ReadCoils(0x05, 10, uint16(len(coils)))
+	if err != nil {
+		t.Fatalf("ReadCoils: %s", err)
+	}
+	if !reflect.DeepEqual(v, coils) {
+		t.Fatalf("ReadCoils: %v != %v", v, coils)
+	}
+
+	regs := []uint16{1, 2, 3, 0xf0f0}
+	if err := c.WriteMultipleRegisters(0x05, 100, regs); err != nil {
+		t.Fatalf("WriteMultipleRegisters: %s", err)
+	}
+	if err := c.WriteSingleRegister(0x05, 100, 0xaaaa); err != nil {
+		t.Fatalf("WriteSingleRegister: %s", err)
+	}
+	if err := c.MaskWriteRegister(0x05, 103, 0xff00, 0x0055); err != nil {
+		t.Fatalf("MaskWriteRegister: %s", err)
+	}
+	regs[0], regs[3] = 0xaaaa, 0xf055
+	r, err := c.ReadHoldingRegisters(0x05, 100, uint16(len(regs)))
+	if err != nil {
+		t.Fatalf("ReadHoldingRegisters: %s", err)
+	}
+	if !reflect.DeepEqual(r, regs) {
+		t.Fatalf("ReadHoldingRegisters: %v != %v", r, regs)
+	}
+	r, err = c.ReadWriteMultipleRegisters(0x05, 101, 2, 102, []uint16{7})
+	if err != nil {
+		t.Fatalf("ReadWriteMultipleRegisters: %s", err)
+	}
+	if !reflect.DeepEqual(r, []uint16{2, 7}) {
+		t.Fatalf("ReadWriteMultipleRegisters: %v", r)
+	}
+
+	_, err = c.ReadInputRegisters(0x05, 0, 2)
+	if err != nil {
+		t.Fatalf("ReadInputRegisters: %s", err)
+	}
+	_, err = c.ReadDiscreteInputs(0x05, 0, 2)
+	if err != nil {
+		t.Fatalf("ReadDiscreteInputs: %s", err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+// Command mbscan discovers the modbus nodes present on a serial bus,
+// or the units behind a modbus-TCP gateway.
+//
+// Usage:
+//
+//	mbscan [flags] -dev /dev/ttyUSB0
+//	mbscan [flags] -tcp 192.168.1.10:502
+//
+// The serial port must be configured (baudrate, parity, etc.)
+// before running mbscan (e.g. using stty); -baud is only used for
+// timing calculations. Run "mbscan -h" for the list of flags.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/npat-efault/modbus"
+)
+
+var (
+	fDev     = flag.String("dev", "", "serial port device")
+	fBaud    = flag.Int("baud", 9600, "serial port baudrate")
+	fTcp     = flag.String("tcp", "", "modbus-TCP gateway address")
+	fFirst   = flag.Int("first", 1, "first node id to probe")
+	fLast    = flag.Int("last", 247, "last node id to probe")
+	fTimeout = flag.Duration("timeout", 0, "response timeout")
+	fProbe   = flag.String("probe", "id",
+		"probe request: id (report-server-id), devid "+
+			"(read-device-id), hreg:ADDR, or ireg:ADDR")
+	fAll = flag.Bool("all", false, "report absent nodes too")
+)
+
+func probe(s string) (modbus.Req, error) {
+	switch s {
+	case "id":
+		return &modbus.ReqSlaveId{}, nil
+	case "devid":
+		return &modbus.ReqRdDevId{Code: modbus.DevIdBasic}, nil
+	}
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("bad probe: %s", s)
+	}
+	addr, err := strconv.ParseUint(s[i+1:], 0, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad probe address: %s", s[i+1:])
+	}
+	switch s[:i] {
+	case "hreg":
+		return &modbus.ReqRdRegs{Holding: true,
+			Addr: uint16(addr), Num: 1}, nil
+	case "ireg":
+		return &modbus.ReqRdRegs{Holding: false,
+			Addr: uint16(addr), Num: 1}, nil
+	}
+	return nil, fmt.Errorf("bad probe: %s", s)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("mbscan: ")
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run does the work of main. Errors are returned (instead of exiting)
+// so that deferred cleanups are executed.
+func run() error {
+	if (*fDev == "") == (*fTcp == "") {
+		return fmt.Errorf("exactly one of -dev or -tcp must be given")
+	}
+	if *fFirst < 0 || *fLast > 255 || *fFirst > *fLast {
+		return fmt.Errorf("bad node id range")
+	}
+	req, err := probe(*fProbe)
+	if err != nil {
+		return err
+	}
+
+	var d modbus.Doer
+	if *fDev != "" {
+		f, err := os.OpenFile(*fDev, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		d = modbus.NewSerMasterStd(f, modbus.SerMasterConf{
+			Baudrate: *fBaud, Timeout: *fTimeout})
+	} else {
+		tm := modbus.NewTcpMaster(*fTcp)
+		if *fTimeout > 0 {
+			tm.Timeout = *fTimeout
+		}
+		defer tm.Close()
+		d = tm
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	var nfound int
+	sc := &modbus.Scanner{
+		Probe: req,
+		First: uint8(*fFirst),
+		Last:  uint8(*fLast),
+		Notify: func(r modbus.ScanResult) {
+			if r.Status == modbus.ScanAbsent && !*fAll {
+				return
+			}
+			if r.Status != modbus.ScanAbsent {
+				nfound++
+			}
+			fmt.Printf("%3d  %-10s %8s", r.Node, r.Status,
+				r.Time.Round(time.Millisecond/10))
+			if r.Err != nil {
+				fmt.Printf("  %s", r.Err)
+			} else if r.Res != nil {
+				fmt.Printf("  %s", describe(r.Res))
+			}
+			fmt.Println()
+		},
+	}
+	_, err = sc.Scan(ctx, d)
+	fmt.Printf("%d node(s) found\n", nfound)
+	if err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+func describe(r modbus.Res) string {
+	switch r := r.(type) {
+	case *modbus.ResSlaveId:
+		return fmt.Sprintf("id: % x", r.Data)
+	case *modbus.ResRdDevId:
+		var s []string
+		for _, o := range r.Objs {
+			s = append(s, fmt.Sprintf("%d=%q", o.Id, o.Val))
+		}
+		return strings.Join(s, " ")
+	case *modbus.ResRdRegs:
+		return fmt.Sprintf("regs: %v", r.Val)
+	}
+	return fmt.Sprintf("%+v", r)
+}
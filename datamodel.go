@@ -0,0 +1,738 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"sort"
+	"sync"
+)
+
+// AddrRange is a range of Num addresses, starting at Addr. Num can be
+// up to 0x10000 (the whole address space).
+type AddrRange struct {
+	Addr uint16
+	Num  int
+}
+
+// end returns the address after the last address in the range
+func (r AddrRange) end() int { return int(r.Addr) + r.Num }
+
+// valid returns true if the range is not empty, and fits in the
+// 16-bit address space.
+func (r AddrRange) valid() bool { return r.Num > 0 && r.end() <= 0x10000 }
+
+// dmSeg is a segment of a data-model table: a contiguous range of
+// registers or bits.
+type dmSeg struct {
+	AddrRange
+	ro   bool
+	regs []uint16
+	bits []bool
+	// Function segments
+	getR RegGetter
+	setR RegSetter
+	getB BitGetter
+	setB BitSetter
+}
+
+// fn returns true if s is a function segment
+func (s *dmSeg) fn() bool { return s.getR != nil || s.getB != nil }
+
+// RegGetter is a function that fills v with the current values of
+// len(v) registers, starting at addr.
+type RegGetter func(addr uint16, v []uint16)
+
+// RegSetter is a function that sets len(v) registers, starting at
+// addr, to the values in v. It returns an exception code (e.g.
+// BadValue, or SrvFail), or zero on success.
+type RegSetter func(addr uint16, v []uint16) ExCode
+
+// BitGetter and BitSetter are like RegGetter and RegSetter, for bits
+// (coils or discrete inputs).
+type (
+	BitGetter func(addr uint16, v []bool)
+	BitSetter func(addr uint16, v []bool) ExCode
+)
+
+// dmPiece is the part of a segment covered by an access.
+type dmPiece struct {
+	s   *dmSeg
+	off int
+	n   int
+}
+
+// DataModel is a ready-made data model (register bank) for modbus
+// slaves (servers), holding the four standard tables: coils, discrete
+// inputs, holding registers, and input registers (see type
+// Table). Each table consists of one or more segments (address
+// ranges), which may be separated by holes (addresses that do not
+// exist). A segment may be read-only, in which case writes to it by
+// the master are rejected; the application can still update it. The
+// zero value is a data model with no segments; add segments using
+// AddSegment.
+//
+// DataModel implements SerHandler: It answers all the standard
+// read and write requests (read coils / discrete-inputs / holding-
+// and input-registers, write single and multiple coils and registers,
+// mask-write-register, and read-write-multiple-registers) from its
+// tables. Requests can span adjacent segments. It replies with
+// BadAddress exceptions to requests that cover (even partially) a
+// hole, ROExc exceptions to writes to read-only segments, BadValue
+// exceptions to requests with invalid quantities, and BadFnCode
+// exceptions to requests for other functions. The Handle method does
+// not look at the node id; it can be used by servers of any
+// transport.
+//
+// Writes by the master to coils and holding registers can be
+// validated, and the application can be notified of them, using
+// write hooks (see OnWrite).
+//
+// A segment can also be a function segment, whose values are not
+// stored in the data model, but are computed by a getter function
+// when read, and passed to a setter function when written (see
+// AddRegFunc and AddBitFunc).
+//
+// It is ok to access the data model (using the Bits, SetBits, Regs,
+// and SetRegs methods) from application goroutines, while it is
+// being used by a slave. Segments and hooks must be added before the
+// data model is used.
+type DataModel struct {
+	// Exception code for writes to read-only segments. If zero,
+	// BadAddress is used.
+	ROExc ExCode
+	// If not nil, FuncLock is held while the getters and setters
+	// involved in a request (or in a call to Bits or Regs) are
+	// called. If the application holds it while updating the
+	// values its getters return, every request sees a consistent
+	// snapshot of them, even if it spans several getters. Bits and
+	// Regs must not be called with FuncLock held.
+	FuncLock sync.Locker
+
+	mu    sync.RWMutex
+	tbl   [TblNum][]*dmSeg
+	hooks [TblNum][]*dmHook
+}
+
+// NewDataModel returns a data model with the given address ranges
+// (one read-write segment each) for coils, discrete inputs, holding
+// registers, and input registers. All values are initially zero. An
+// empty range (Num == 0) means that the respective table has no
+// segments. Ranges that do not fit in the 16-bit address space are
+// treated as empty.
+func NewDataModel(coils, inputs, hregs, iregs AddrRange) *DataModel {
+	dm := &DataModel{}
+	for t, r := range [TblNum]AddrRange{coils, inputs, hregs, iregs} {
+		if r.valid() {
+			dm.AddSegment(Table(t), r, false)
+		}
+	}
+	return dm
+}
+
+// AddSegment adds a segment, with the given address range, to table
+// t. If ro is true, the segment is read-only (for the master). All
+// values are initially zero. It returns ErrAddress if the range is
+// empty, does not fit in the 16-bit address space, or overlaps with
+// another segment of the table.
+func (dm *DataModel) AddSegment(t Table, r AddrRange, ro bool) error {
+	if t >= TblNum || !r.valid() {
+		return ErrAddress
+	}
+	s := &dmSeg{AddrRange: r, ro: ro}
+	if t.IsBits() {
+		s.bits = make([]bool, r.Num)
+	} else {
+		s.regs = make([]uint16, r.Num)
+	}
+	return dm.addSeg(t, s)
+}
+
+// AddRegFunc adds a function segment, with the given address range,
+// to table t (TblHoldingRegs or TblInputRegs). Reads of registers in
+// the segment call get; writes by the master call set. If set is
+// nil, the segment is read-only (for TblInputRegs, set is not
+// used). Getters and setters are called with the data model locked,
+// and must not call its methods. If a write spans several segments,
+// and a setter rejects it, no storage segment is written, but the
+// setters called before it are not undone. Function segments cannot
+// be set using SetRegs. It returns ErrAddress if t is not a register
+// table, get is nil, or the range is not valid or overlaps with
+// another segment of the table.
+func (dm *DataModel) AddRegFunc(t Table, r AddrRange,
+	get RegGetter, set RegSetter) error {
+	if t.IsBits() || t >= TblNum || get == nil || !r.valid() {
+		return ErrAddress
+	}
+	if t != TblHoldingRegs {
+		set = nil
+	}
+	s := &dmSeg{AddrRange: r, ro: set == nil, getR: get, setR: set}
+	return dm.addSeg(t, s)
+}
+
+// AddBitFunc is like AddRegFunc, for table TblCoils or TblInputs.
+func (dm *DataModel) AddBitFunc(t Table, r AddrRange,
+	get BitGetter, set BitSetter) error {
+	if !t.IsBits() || get == nil || !r.valid() {
+		return ErrAddress
+	}
+	if t != TblCoils {
+		set = nil
+	}
+	s := &dmSeg{AddrRange: r, ro: set == nil, getB: get, setB: set}
+	return dm.addSeg(t, s)
+}
+
+// addSeg inserts segment s in table t, keeping the table sorted.
+func (dm *DataModel) addSeg(t Table, s *dmSeg) error {
+	r := s.AddrRange
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	segs := dm.tbl[t]
+	i := sort.Search(len(segs), func(i int) bool {
+		return segs[i].Addr >= r.Addr
+	})
+	if (i > 0 && segs[i-1].end() > int(r.Addr)) ||
+		(i < len(segs) && r.end() > int(segs[i].Addr)) {
+		return ErrAddress
+	}
+	segs = append(segs, nil)
+	copy(segs[i+1:], segs[i:])
+	segs[i] = s
+	dm.tbl[t] = segs
+	return nil
+}
+
+// span returns the pieces of the segments of table t that cover the
+// n registers or bits starting at addr. It returns nil if they are
+// not fully covered (the range covers a hole). Must be called with
+// dm.mu held.
+func (dm *DataModel) span(t Table, addr uint16, n int) []dmPiece {
+	if t >= TblNum || n < 1 || int(addr)+n > 0x10000 {
+		return nil
+	}
+	segs := dm.tbl[t]
+	// First segment ending after addr
+	i := sort.Search(len(segs), func(i int) bool {
+		return segs[i].end() > int(addr)
+	})
+	var ps []dmPiece
+	a, end := int(addr), int(addr)+n
+	for ; a < end; i++ {
+		if i >= len(segs) || int(segs[i].Addr) > a {
+			return nil
+		}
+		s := segs[i]
+		c := s.end() - a
+		if c > end-a {
+			c = end - a
+		}
+		ps = append(ps, dmPiece{s, a - int(s.Addr), c})
+		a += c
+	}
+	return ps
+}
+
+// roPieces returns true if any of the pieces is read-only.
+func roPieces(ps []dmPiece) bool {
+	for _, p := range ps {
+		if p.s.ro {
+			return true
+		}
+	}
+	return false
+}
+
+// fnPieces returns true if any of the pieces is in a function
+// segment.
+func fnPieces(ps []dmPiece) bool {
+	for _, p := range ps {
+		if p.s.fn() {
+			return true
+		}
+	}
+	return false
+}
+
+// lock and unlock acquire and release FuncLock (if set) and dm.mu,
+// for accesses that may call getters or setters. rlock and runlock
+// are the same, but acquire dm.mu for reading.
+
+func (dm *DataModel) lock() {
+	if dm.FuncLock != nil {
+		dm.FuncLock.Lock()
+	}
+	dm.mu.Lock()
+}
+
+func (dm *DataModel) unlock() {
+	dm.mu.Unlock()
+	if dm.FuncLock != nil {
+		dm.FuncLock.Unlock()
+	}
+}
+
+func (dm *DataModel) rlock() {
+	if dm.FuncLock != nil {
+		dm.FuncLock.Lock()
+	}
+	dm.mu.RLock()
+}
+
+func (dm *DataModel) runlock() {
+	dm.mu.RUnlock()
+	if dm.FuncLock != nil {
+		dm.FuncLock.Unlock()
+	}
+}
+
+// roExc returns the exception code for writes to read-only segments.
+func (dm *DataModel) roExc() ExCode {
+	if dm.ROExc == 0 {
+		return BadAddress
+	}
+	return dm.ROExc
+}
+
+// getBits, setBits, getRegs, and setRegs access the pieces of
+// segments given, calling the getters and setters of function
+// segments. The setters return the exception code of the first
+// setter that failed (zero on success). They call all setters
+// before writing to storage segments, which are not written if a
+// setter fails. Must be called with dm.mu held.
+
+// addr returns the address of the first value in piece p
+func (p dmPiece) addr() uint16 { return uint16(int(p.s.Addr) + p.off) }
+
+func getBits(ps []dmPiece, n int) []bool {
+	v := make([]bool, n)
+	i := 0
+	for _, p := range ps {
+		if p.s.getB != nil {
+			p.s.getB(p.addr(), v[i:i+p.n])
+		} else {
+			copy(v[i:], p.s.bits[p.off:p.off+p.n])
+		}
+		i += p.n
+	}
+	return v
+}
+
+func setBits(ps []dmPiece, v []bool) ExCode {
+	i := 0
+	for _, p := range ps {
+		if p.s.setB != nil {
+			if ec := p.s.setB(p.addr(), v[i:i+p.n]); ec != 0 {
+				return ec
+			}
+		}
+		i += p.n
+	}
+	i = 0
+	for _, p := range ps {
+		if p.s.setB == nil {
+			copy(p.s.bits[p.off:p.off+p.n], v[i:])
+		}
+		i += p.n
+	}
+	return 0
+}
+
+func getRegs(ps []dmPiece, n int) []uint16 {
+	v := make([]uint16, n)
+	i := 0
+	for _, p := range ps {
+		if p.s.getR != nil {
+			p.s.getR(p.addr(), v[i:i+p.n])
+		} else {
+			copy(v[i:], p.s.regs[p.off:p.off+p.n])
+		}
+		i += p.n
+	}
+	return v
+}
+
+func setRegs(ps []dmPiece, v []uint16) ExCode {
+	i := 0
+	for _, p := range ps {
+		if p.s.setR != nil {
+			if ec := p.s.setR(p.addr(), v[i:i+p.n]); ec != 0 {
+				return ec
+			}
+		}
+		i += p.n
+	}
+	i = 0
+	for _, p := range ps {
+		if p.s.setR == nil {
+			copy(p.s.regs[p.off:p.off+p.n], v[i:])
+		}
+		i += p.n
+	}
+	return 0
+}
+
+// Bits returns the values of n bits of table t (TblCoils or
+// TblInputs), starting at addr. It returns ErrAddress if any of them
+// does not exist.
+func (dm *DataModel) Bits(t Table, addr uint16, n int) ([]bool, error) {
+	if !t.IsBits() {
+		return nil, ErrAddress
+	}
+	dm.rlock()
+	defer dm.runlock()
+	ps := dm.span(t, addr, n)
+	if ps == nil {
+		return nil, ErrAddress
+	}
+	return getBits(ps, n), nil
+}
+
+// SetBits sets len(v) bits of table t (TblCoils or TblInputs),
+// starting at addr, to the values in v. It returns ErrAddress if any
+// of them does not exist, or is in a function segment. Read-only
+// segments can be set.
+func (dm *DataModel) SetBits(t Table, addr uint16, v []bool) error {
+	if !t.IsBits() {
+		return ErrAddress
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	ps := dm.span(t, addr, len(v))
+	if ps == nil || fnPieces(ps) {
+		return ErrAddress
+	}
+	setBits(ps, v)
+	return nil
+}
+
+// Regs returns the values of n registers of table t (TblHoldingRegs
+// or TblInputRegs), starting at addr. It returns ErrAddress if any of
+// them does not exist.
+func (dm *DataModel) Regs(t Table, addr uint16, n int) ([]uint16, error) {
+	if t.IsBits() {
+		return nil, ErrAddress
+	}
+	dm.rlock()
+	defer dm.runlock()
+	ps := dm.span(t, addr, n)
+	if ps == nil {
+		return nil, ErrAddress
+	}
+	return getRegs(ps, n), nil
+}
+
+// SetRegs sets len(v) registers of table t (TblHoldingRegs or
+// TblInputRegs), starting at addr, to the values in v. It returns
+// ErrAddress if any of them does not exist, or is in a function
+// segment. Read-only segments can be set.
+func (dm *DataModel) SetRegs(t Table, addr uint16, v []uint16) error {
+	if t.IsBits() {
+		return ErrAddress
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	ps := dm.span(t, addr, len(v))
+	if ps == nil || fnPieces(ps) {
+		return ErrAddress
+	}
+	setRegs(ps, v)
+	return nil
+}
+
+// WriteEvent describes a write by the master to coils or holding
+// registers covered by a write hook (see DataModel.OnWrite). It only
+// covers the part of the write that falls in the hook's address
+// range. For coils, OldBits and NewBits hold the values before and
+// after the write; for holding registers, Old and New do. The slices
+// must not be modified or retained.
+type WriteEvent struct {
+	// Node id the request was addressed to
+	Node  uint8
+	Table Table
+	Addr  uint16
+	// Values before and after the write (holding registers)
+	Old, New []uint16
+	// Values before and after the write (coils)
+	OldBits, NewBits []bool
+}
+
+// dmHook is a write hook attached to an address range
+type dmHook struct {
+	AddrRange
+	validate func(e *WriteEvent) ExCode
+	notify   func(e *WriteEvent)
+}
+
+// dmNotify is a pending call of a write-hook notifier
+type dmNotify struct {
+	fn func(e *WriteEvent)
+	e  *WriteEvent
+}
+
+// OnWrite attaches a write hook to range r of table t (TblCoils or
+// TblHoldingRegs). The hook is invoked for writes by the master
+// (write single and multiple coils and registers, mask-write-register,
+// and the write part of read-write-multiple-registers) that cover, at
+// least partially, range r. Writes by the application (SetBits,
+// SetRegs) do not invoke hooks.
+//
+// Validate, if not nil, is called before the write is committed. If
+// it returns a non-zero exception code (e.g. BadValue, or SrvFail),
+// the write is rejected as a whole, nothing is changed, and the
+// master receives this exception. Notify, if not nil, is called after
+// the write has been committed. Validators are called with the data
+// model locked, and must not call its methods; notifiers are called
+// with the data model unlocked. Both are called from the slave's
+// goroutine, so they should return quickly. Hooks may overlap; they
+// are called in the order they were added. It returns ErrAddress if t
+// is not a writable table, or r is not valid. Hooks must be added
+// before the data model is used.
+func (dm *DataModel) OnWrite(t Table, r AddrRange,
+	validate func(e *WriteEvent) ExCode, notify func(e *WriteEvent)) error {
+	if (t != TblCoils && t != TblHoldingRegs) || !r.valid() {
+		return ErrAddress
+	}
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.hooks[t] = append(dm.hooks[t], &dmHook{r, validate, notify})
+	return nil
+}
+
+// validate calls the validators of the hooks of table t that overlap
+// the write of n values at addr. Function ev returns the event for
+// values [i, j) of the write, starting at address a. It returns the
+// notifier calls to be made after the write is committed, or the
+// exception code of the first validator that rejected the write. Must
+// be called with dm.mu held.
+func (dm *DataModel) validate(t Table, addr uint16, n int,
+	ev func(a uint16, i, j int) *WriteEvent) ([]dmNotify, ExCode) {
+	var ns []dmNotify
+	for _, h := range dm.hooks[t] {
+		lo, hi := int(addr), int(addr)+n
+		if int(h.Addr) > lo {
+			lo = int(h.Addr)
+		}
+		if h.end() < hi {
+			hi = h.end()
+		}
+		if lo >= hi {
+			continue
+		}
+		e := ev(uint16(lo), lo-int(addr), hi-int(addr))
+		if h.validate != nil {
+			if ec := h.validate(e); ec != 0 {
+				return nil, ec
+			}
+		}
+		if h.notify != nil {
+			ns = append(ns, dmNotify{h.notify, e})
+		}
+	}
+	return ns, 0
+}
+
+// notify makes the notifier calls ns. Must be called with dm.mu not
+// held.
+func notify(ns []dmNotify) {
+	for _, n := range ns {
+		n.fn(n.e)
+	}
+}
+
+// commitBits and commitRegs validate and commit a write by the master
+// of values v to pieces ps (at address addr), which must not be
+// read-only. They return the notifier calls to be made, or the
+// exception code if the write was rejected (by a validator or a
+// setter). Must be called with dm.mu held.
+
+func (dm *DataModel) commitBits(node uint8, ps []dmPiece,
+	addr uint16, v []bool) ([]dmNotify, ExCode) {
+	var old []bool
+	if len(dm.hooks[TblCoils]) > 0 {
+		old = getBits(ps, len(v))
+	}
+	ns, ec := dm.validate(TblCoils, addr, len(v),
+		func(a uint16, i, j int) *WriteEvent {
+			return &WriteEvent{Node: node, Table: TblCoils, Addr: a,
+				OldBits: old[i:j], NewBits: v[i:j]}
+		})
+	if ec != 0 {
+		return nil, ec
+	}
+	if ec := setBits(ps, v); ec != 0 {
+		return nil, ec
+	}
+	return ns, 0
+}
+
+func (dm *DataModel) commitRegs(node uint8, ps []dmPiece,
+	addr uint16, v []uint16) ([]dmNotify, ExCode) {
+	var old []uint16
+	if len(dm.hooks[TblHoldingRegs]) > 0 {
+		old = getRegs(ps, len(v))
+	}
+	ns, ec := dm.validate(TblHoldingRegs, addr, len(v),
+		func(a uint16, i, j int) *WriteEvent {
+			return &WriteEvent{Node: node, Table: TblHoldingRegs, Addr: a,
+				Old: old[i:j], New: v[i:j]}
+		})
+	if ec != 0 {
+		return nil, ec
+	}
+	if ec := setRegs(ps, v); ec != 0 {
+		return nil, ec
+	}
+	return ns, 0
+}
+
+// wrBits writes bits for the master, and returns the exception code
+// (zero on success).
+func (dm *DataModel) wrBits(node uint8, addr uint16, v []bool) ExCode {
+	dm.lock()
+	ps := dm.span(TblCoils, addr, len(v))
+	if ps == nil {
+		dm.unlock()
+		return BadAddress
+	}
+	if roPieces(ps) {
+		dm.unlock()
+		return dm.roExc()
+	}
+	ns, ec := dm.commitBits(node, ps, addr, v)
+	dm.unlock()
+	notify(ns)
+	return ec
+}
+
+// wrRegs writes holding registers for the master, and returns the
+// exception code (zero on success). If mask is true, v must hold
+// two values (the and- and or-masks of a mask-write-register
+// request), which are applied to the register at addr.
+func (dm *DataModel) wrRegs(node uint8, addr uint16, v []uint16, mask bool) ExCode {
+	n := len(v)
+	if mask {
+		n = 1
+	}
+	dm.lock()
+	ps := dm.span(TblHoldingRegs, addr, n)
+	if ps == nil {
+		dm.unlock()
+		return BadAddress
+	}
+	if roPieces(ps) {
+		dm.unlock()
+		return dm.roExc()
+	}
+	if mask {
+		and, or := v[0], v[1]
+		v = []uint16{getRegs(ps, 1)[0]&and | or&^and}
+	}
+	ns, ec := dm.commitRegs(node, ps, addr, v)
+	dm.unlock()
+	notify(ns)
+	return ec
+}
+
+// Handle handles request req, and returns the response. See type
+// DataModel.
+func (dm *DataModel) Handle(node uint8, req Req) Res {
+	exc := func(ec ExCode) Res {
+		return &ResExc{Function: req.FnCode(), ExCode: ec}
+	}
+	switch r := req.(type) {
+	case *ReqRdInputs:
+		if r.Num < 1 || r.Num > MaxRdBits {
+			return exc(BadValue)
+		}
+		t := TblInputs
+		if r.Coils {
+			t = TblCoils
+		}
+		v, err := dm.Bits(t, r.Addr, int(r.Num))
+		if err != nil {
+			return exc(BadAddress)
+		}
+		return &ResRdInputs{Coils: r.Coils, BitStat: packBits(v)}
+	case *ReqRdRegs:
+		if r.Num < 1 || r.Num > MaxRdRegs {
+			return exc(BadValue)
+		}
+		t := TblInputRegs
+		if r.Holding {
+			t = TblHoldingRegs
+		}
+		v, err := dm.Regs(t, r.Addr, int(r.Num))
+		if err != nil {
+			return exc(BadAddress)
+		}
+		return &ResRdRegs{Holding: r.Holding, Val: v}
+	case *ReqResWrCoil:
+		if ec := dm.wrBits(node, r.Addr, []bool{r.Status}); ec != 0 {
+			return exc(ec)
+		}
+		return r
+	case *ReqResWrReg:
+		if ec := dm.wrRegs(node, r.Addr, []uint16{r.Val}, false); ec != 0 {
+			return exc(ec)
+		}
+		return r
+	case *ReqWrCoils:
+		if r.Num < 1 || r.Num > MaxWrBits ||
+			len(r.BitStat) != (int(r.Num)+7)/8 {
+			return exc(BadValue)
+		}
+		v := unpackBits(r.BitStat, int(r.Num))
+		if ec := dm.wrBits(node, r.Addr, v); ec != 0 {
+			return exc(ec)
+		}
+		return &ResWrCoils{Addr: r.Addr, Num: r.Num}
+	case *ReqWrRegs:
+		if len(r.Val) < 1 || len(r.Val) > MaxWrRegs {
+			return exc(BadValue)
+		}
+		if ec := dm.wrRegs(node, r.Addr, r.Val, false); ec != 0 {
+			return exc(ec)
+		}
+		return &ResWrRegs{Addr: r.Addr, Num: uint16(len(r.Val))}
+	case *ReqResMskWrReg:
+		mv := []uint16{r.AndMsk, r.OrMsk}
+		if ec := dm.wrRegs(node, r.Addr, mv, true); ec != 0 {
+			return exc(ec)
+		}
+		return r
+	case *ReqRdWrRegs:
+		if r.RdNum < 1 || r.RdNum > MaxRdRegs ||
+			len(r.WrVal) < 1 || len(r.WrVal) > MaxRdWrRegs {
+			return exc(BadValue)
+		}
+		dm.lock()
+		wps := dm.span(TblHoldingRegs, r.WrAddr, len(r.WrVal))
+		rps := dm.span(TblHoldingRegs, r.RdAddr, int(r.RdNum))
+		if wps == nil || rps == nil {
+			dm.unlock()
+			return exc(BadAddress)
+		}
+		if roPieces(wps) {
+			dm.unlock()
+			return exc(dm.roExc())
+		}
+		// Write is performed before the read
+		ns, ec := dm.commitRegs(node, wps, r.WrAddr, r.WrVal)
+		var v []uint16
+		if ec == 0 {
+			v = getRegs(rps, int(r.RdNum))
+		}
+		dm.unlock()
+		notify(ns)
+		if ec != 0 {
+			return exc(ec)
+		}
+		return &ResRdWrRegs{Val: v}
+	default:
+		return exc(BadFnCode)
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// handlerDoer is a Doer that passes requests directly to a handler,
+// through pack / unpack.
+type handlerDoer struct {
+	h SerHandler
+}
+
+func (d handlerDoer) Do(node uint8, req Req, res Res) (Res, error) {
+	b, err := req.Pack(nil)
+	if err != nil {
+		return nil, ErrRequest
+	}
+	req, _ = NewReq(req.FnCode())
+	if _, err := req.Unpack(b); err != nil {
+		return nil, ErrRequest
+	}
+	r := d.h.Handle(node, req)
+	b, err = r.Pack(nil)
+	if err != nil {
+		return nil, ErrResponse
+	}
+	return unpackRes(PDU(b), req.FnCode(), res)
+}
+
+func isExc(err error, ec ExCode) bool {
+	e, ok := err.(*ResExc)
+	return ok && e.ExCode == ec
+}
+
+func TestDataModel(t *testing.T) {
+	dm := NewDataModel(AddrRange{0, 100}, AddrRange{100, 16},
+		AddrRange{1000, 50}, AddrRange{})
+	c := NewClient(handlerDoer{dm})
+
+	if err := c.WriteMultipleRegisters(1, 1010, []uint16{1, 2, 3}); err != nil {
+		t.Fatalf("WriteMultipleRegisters: %s", err)
+	}
+	v, err := c.ReadHoldingRegisters(1, 1009, 5)
+	if err != nil || !reflect.DeepEqual(v, []uint16{0, 1, 2, 3, 0}) {
+		t.Fatalf("ReadHoldingRegisters: %v, %v", v, err)
+	}
+	if err := c.MaskWriteRegister(1, 1010, 0xfff0, 0x0004); err != nil {
+		t.Fatalf("MaskWriteRegister: %s", err)
+	}
+	v, err = c.ReadWriteMultipleRegisters(1, 1010, 2, 1011, []uint16{9})
+	if err != nil || !reflect.DeepEqual(v, []uint16{4, 9}) {
+		t.Fatalf("ReadWriteMultipleRegisters: %v, %v", v, err)
+	}
+	if err := c.WriteMultipleCoils(1, 98, []bool{true, true}); err != nil {
+		t.Fatalf("WriteMultipleCoils: %s", err)
+	}
+	if err := c.WriteSingleCoil(1, 0, true); err != nil {
+		t.Fatalf("WriteSingleCoil: %s", err)
+	}
+	bits, err := dm.Bits(TblCoils, 97, 3)
+	if err != nil || !reflect.DeepEqual(bits, []bool{false, true, true}) {
+		t.Fatalf("Bits: %v, %v", bits, err)
+	}
+
+	// Application-side updates
+	if err := dm.SetBits(TblInputs, 115, []bool{true}); err != nil {
+		t.Fatalf("SetBits: %s", err)
+	}
+	bits, err = c.ReadDiscreteInputs(1, 114, 2)
+	if err != nil || !reflect.DeepEqual(bits, []bool{false, true}) {
+		t.Fatalf("ReadDiscreteInputs: %v, %v", bits, err)
+	}
+	if err := dm.SetRegs(TblHoldingRegs, 1049, []uint16{1, 2}); err != ErrAddress {
+		t.Fatalf("Expected ErrAddress, got: %v", err)
+	}
+
+	// Exceptions
+	if _, err := c.ReadHoldingRegisters(1, 1048, 3); !isExc(err, BadAddress) {
+		t.Fatalf("Expected BadAddress, got: %v", err)
+	}
+	if _, err := c.ReadInputRegisters(1, 0, 1); !isExc(err, BadAddress) {
+		t.Fatalf("Expected BadAddress, got: %v", err)
+	}
+	if err := c.WriteSingleCoil(1, 100, true); !isExc(err, BadAddress) {
+		t.Fatalf("Expected BadAddress, got: %v", err)
+	}
+	r := dm.Handle(1, &ReqRdRegs{Holding: true, Addr: 1000, Num: 126})
+	if e, ok := r.(*ResExc); !ok || e.ExCode != BadValue {
+		t.Fatalf("Expected BadValue, got: %v", r)
+	}
+	if _, err := (handlerDoer{dm}).Do(1, &ReqSlaveId{}, nil); !isExc(err, BadFnCode) {
+		t.Fatalf("Expected BadFnCode, got: %v", err)
+	}
+}
+
+func TestDataModelConcurrent(t *testing.T) {
+	dm := NewDataModel(AddrRange{}, AddrRange{},
+		AddrRange{0, 0x10000}, AddrRange{})
+	c := NewClient(handlerDoer{dm})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			dm.SetRegs(TblHoldingRegs, 0xfffe, []uint16{uint16(i), uint16(i)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			v, err := c.ReadHoldingRegisters(1, 0xfffe, 2)
+			if err != nil || v[0] != v[1] {
+				t.Errorf("Read: %v, %v", v, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestDataModelSegments(t *testing.T) {
+	dm := &DataModel{ROExc: BadValue}
+	segs := []struct {
+		r  AddrRange
+		ro bool
+	}{
+		{AddrRange{0, 100}, false},
+		{AddrRange{1000, 50}, true},
+		{AddrRange{1050, 10}, false},
+		{AddrRange{40000, 201}, false},
+	}
+	for _, s := range segs {
+		if err := dm.AddSegment(TblHoldingRegs, s.r, s.ro); err != nil {
+			t.Fatalf("AddSegment %+v: %s", s.r, err)
+		}
+	}
+	if err := dm.AddSegment(TblHoldingRegs, AddrRange{1040, 5}, false); err != ErrAddress {
+		t.Fatalf("Overlapping segment: %v", err)
+	}
+	if err := dm.AddSegment(TblInputRegs, AddrRange{0xffff, 2}, false); err != ErrAddress {
+		t.Fatalf("Segment beyond address space: %v", err)
+	}
+	c := NewClient(handlerDoer{dm})
+
+	// Read-only segment: application can set, master cannot
+	if err := dm.SetRegs(TblHoldingRegs, 1048, []uint16{7, 8}); err != nil {
+		t.Fatalf("SetRegs: %s", err)
+	}
+	if err := c.WriteSingleRegister(1, 1049, 1); !isExc(err, BadValue) {
+		t.Fatalf("Expected BadValue, got: %v", err)
+	}
+	// Span adjacent segments
+	if err := c.WriteMultipleRegisters(1, 1050, []uint16{9}); err != nil {
+		t.Fatalf("WriteMultipleRegisters: %s", err)
+	}
+	v, err := c.ReadHoldingRegisters(1, 1048, 3)
+	if err != nil || !reflect.DeepEqual(v, []uint16{7, 8, 9}) {
+		t.Fatalf("ReadHoldingRegisters: %v, %v", v, err)
+	}
+	// Write spanning into read-only segment
+	if err := c.WriteMultipleRegisters(1, 1049, []uint16{1, 2}); !isExc(err, BadValue) {
+		t.Fatalf("Expected BadValue, got: %v", err)
+	}
+	// Holes
+	for _, r := range []AddrRange{{99, 2}, {1059, 2}, {500, 1}, {40200, 2}} {
+		_, err := c.ReadHoldingRegisters(1, r.Addr, uint16(r.Num))
+		if !isExc(err, BadAddress) {
+			t.Fatalf("Read %+v: Expected BadAddress, got: %v", r, err)
+		}
+	}
+	if _, err := c.ReadHoldingRegisters(1, 40000, 125); err != nil {
+		t.Fatalf("ReadHoldingRegisters: %s", err)
+	}
+}
+
+func TestDataModelHooks(t *testing.T) {
+	dm := NewDataModel(AddrRange{0, 16}, AddrRange{}, AddrRange{0, 100},
+		AddrRange{})
+	var evs []WriteEvent
+	rec := func(e *WriteEvent) { evs = append(evs, *e) }
+	// Registers 10-19: values must be < 100
+	err := dm.OnWrite(TblHoldingRegs, AddrRange{10, 10},
+		func(e *WriteEvent) ExCode {
+			for _, v := range e.New {
+				if v >= 100 {
+					return BadValue
+				}
+			}
+			return 0
+		}, rec)
+	if err != nil {
+		t.Fatalf("OnWrite: %s", err)
+	}
+	// Register 15: fails while busy
+	busy := false
+	err = dm.OnWrite(TblHoldingRegs, AddrRange{15, 1},
+		func(e *WriteEvent) ExCode {
+			if busy {
+				return SrvFail
+			}
+			return 0
+		}, nil)
+	if err != nil {
+		t.Fatalf("OnWrite: %s", err)
+	}
+	if err := dm.OnWrite(TblCoils, AddrRange{0, 4}, nil, rec); err != nil {
+		t.Fatalf("OnWrite: %s", err)
+	}
+	if err := dm.OnWrite(TblInputRegs, AddrRange{0, 4}, nil, rec); err != ErrAddress {
+		t.Fatalf("OnWrite input registers: %v", err)
+	}
+	c := NewClient(handlerDoer{dm})
+
+	// Partially covered write: event only for the covered part
+	if err := c.WriteMultipleRegisters(1, 8, []uint16{1, 2, 3, 4}); err != nil {
+		t.Fatalf("WriteMultipleRegisters: %s", err)
+	}
+	exp := []WriteEvent{{Node: 1, Table: TblHoldingRegs, Addr: 10,
+		Old: []uint16{0, 0}, New: []uint16{3, 4}}}
+	if !reflect.DeepEqual(evs, exp) {
+		t.Fatalf("Events: %+v", evs)
+	}
+	// Rejected write: nothing changes, no events
+	evs = nil
+	if err := c.WriteMultipleRegisters(1, 8, []uint16{5, 6, 7, 100}); !isExc(err, BadValue) {
+		t.Fatalf("Expected BadValue, got: %v", err)
+	}
+	v, _ := dm.Regs(TblHoldingRegs, 8, 4)
+	if !reflect.DeepEqual(v, []uint16{1, 2, 3, 4}) || evs != nil {
+		t.Fatalf("Rejected write: %v, %+v", v, evs)
+	}
+	// Mask write reports computed value
+	if err := c.MaskWriteRegister(2, 11, 0xfffe, 0x0001); err != nil {
+		t.Fatalf("MaskWriteRegister: %s", err)
+	}
+	exp = []WriteEvent{{Node: 2, Table: TblHoldingRegs, Addr: 11,
+		Old: []uint16{4}, New: []uint16{5}}}
+	if !reflect.DeepEqual(evs, exp) {
+		t.Fatalf("Events: %+v", evs)
+	}
+	// Coils
+	evs = nil
+	if err := c.WriteMultipleCoils(1, 2, []bool{true, true, true}); err != nil {
+		t.Fatalf("WriteMultipleCoils: %s", err)
+	}
+	exp = []WriteEvent{{Node: 1, Table: TblCoils, Addr: 2,
+		OldBits: []bool{false, false}, NewBits: []bool{true, true}}}
+	if !reflect.DeepEqual(evs, exp) {
+		t.Fatalf("Events: %+v", evs)
+	}
+	// Second hook rejects; read-write does not read
+	busy = true
+	_, err = c.ReadWriteMultipleRegisters(1, 15, 1, 15, []uint16{1})
+	if !isExc(err, SrvFail) {
+		t.Fatalf("Expected SrvFail, got: %v", err)
+	}
+	// Notifier may access the data model
+	dm.OnWrite(TblCoils, AddrRange{8, 1}, nil, func(e *WriteEvent) {
+		dm.SetRegs(TblHoldingRegs, 99, []uint16{42})
+	})
+	if err := c.WriteSingleCoil(1, 8, true); err != nil {
+		t.Fatalf("WriteSingleCoil: %s", err)
+	}
+	if v, _ := dm.Regs(TblHoldingRegs, 99, 1); v[0] != 42 {
+		t.Fatalf("Notifier did not run: %v", v)
+	}
+}
+
+func TestDataModelFunc(t *testing.T) {
+	var mu sync.Mutex
+	dm := NewDataModel(AddrRange{}, AddrRange{}, AddrRange{0, 10},
+		AddrRange{})
+	dm.FuncLock = &mu
+	// Two input-register getters, returning a counter; they must
+	// always agree.
+	var cnt uint16
+	get := func(addr uint16, v []uint16) {
+		for i := range v {
+			v[i] = cnt
+		}
+	}
+	if err := dm.AddRegFunc(TblInputRegs, AddrRange{0, 2}, get, nil); err != nil {
+		t.Fatalf("AddRegFunc: %s", err)
+	}
+	if err := dm.AddRegFunc(TblInputRegs, AddrRange{2, 2}, get, nil); err != nil {
+		t.Fatalf("AddRegFunc: %s", err)
+	}
+	if err := dm.AddRegFunc(TblInputRegs, AddrRange{3, 2}, get, nil); err != ErrAddress {
+		t.Fatalf("Overlapping AddRegFunc: %v", err)
+	}
+	// Holding registers 10-11 backed by variable, which rejects
+	// odd values.
+	var val [2]uint16
+	err := dm.AddRegFunc(TblHoldingRegs, AddrRange{10, 2},
+		func(addr uint16, v []uint16) {
+			copy(v, val[addr-10:])
+		},
+		func(addr uint16, v []uint16) ExCode {
+			for _, x := range v {
+				if x&1 != 0 {
+					return BadValue
+				}
+			}
+			copy(val[addr-10:], v)
+			return 0
+		})
+	if err != nil {
+		t.Fatalf("AddRegFunc: %s", err)
+	}
+	var coil bool
+	err = dm.AddBitFunc(TblCoils, AddrRange{5, 1},
+		func(addr uint16, v []bool) { v[0] = coil },
+		func(addr uint16, v []bool) ExCode { coil = v[0]; return 0 })
+	if err != nil {
+		t.Fatalf("AddBitFunc: %s", err)
+	}
+	if err := dm.AddBitFunc(TblCoils, AddrRange{6, 1}, nil, nil); err != ErrAddress {
+		t.Fatalf("AddBitFunc without getter: %v", err)
+	}
+	c := NewClient(handlerDoer{dm})
+
+	// Write spanning storage and function segments
+	if err := c.WriteMultipleRegisters(1, 9, []uint16{1, 2, 4}); err != nil {
+		t.Fatalf("WriteMultipleRegisters: %s", err)
+	}
+	if val != [2]uint16{2, 4} {
+		t.Fatalf("Setter not called: %v", val)
+	}
+	if err := c.WriteSingleRegister(1, 11, 3); !isExc(err, BadValue) {
+		t.Fatalf("Expected BadValue, got: %v", err)
+	}
+	if err := c.MaskWriteRegister(1, 10, 0x0000, 0x0010); err != nil {
+		t.Fatalf("MaskWriteRegister: %s", err)
+	}
+	v, err := c.ReadHoldingRegisters(1, 8, 4)
+	if err != nil || !reflect.DeepEqual(v, []uint16{0, 1, 0x10, 4}) {
+		t.Fatalf("ReadHoldingRegisters: %v, %v", v, err)
+	}
+	// Rejected write spanning storage and function segments
+	if err := c.WriteMultipleRegisters(1, 8, []uint16{6, 7, 8, 9}); !isExc(err, BadValue) {
+		t.Fatalf("Expected BadValue, got: %v", err)
+	}
+	v, err = c.ReadHoldingRegisters(1, 8, 4)
+	if err != nil || !reflect.DeepEqual(v, []uint16{0, 1, 0x10, 4}) {
+		t.Fatalf("Rejected write changed values: %v, %v", v, err)
+	}
+	if err := dm.SetRegs(TblHoldingRegs, 10, []uint16{0}); err != ErrAddress {
+		t.Fatalf("SetRegs on function segment: %v", err)
+	}
+	if err := c.WriteSingleCoil(1, 5, true); err != nil || !coil {
+		t.Fatalf("WriteSingleCoil: %v, %v", coil, err)
+	}
+	if b, err := c.ReadCoils(1, 5, 1); err != nil || !b[0] {
+		t.Fatalf("ReadCoils: %v, %v", b, err)
+	}
+
+	// Consistent snapshot across getters
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			mu.Lock()
+			cnt++
+			mu.Unlock()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		v, err := c.ReadInputRegisters(1, 0, 4)
+		if err != nil {
+			t.Fatalf("ReadInputRegisters: %s", err)
+		}
+		for _, x := range v[1:] {
+			if x != v[0] {
+				t.Fatalf("Inconsistent snapshot: %v", v)
+			}
+		}
+	}
+	<-done
+}
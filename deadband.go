@@ -0,0 +1,150 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"math"
+	"time"
+)
+
+// Quality flags for polled values. A value with no flags set
+// (QualGood) was read successfully.
+type Quality uint8
+
+const (
+	// QualStale is set if the value is not fresh: The last read
+	// failed, and the value is the last good one (if any).
+	QualStale Quality = 1 << iota
+	// QualCommFail is set if the last read failed due to a
+	// communication error (timeout, bad CRC, framing error, I/O
+	// error, bad response, etc).
+	QualCommFail
+	// QualExc is set if the last read failed due to an exception
+	// response. The exception code is reported along with the
+	// value.
+	QualExc
+
+	QualGood Quality = 0
+)
+
+// QualityOf returns the quality flags, and the exception code (if
+// any), corresponding to the error err returned by a read
+// operation. A nil error corresponds to QualGood. Exception responses
+// (*ResExc) correspond to QualExc; all other errors to QualCommFail.
+// QualStale is never returned by QualityOf.
+func QualityOf(err error) (Quality, ExCode) {
+	if err == nil {
+		return QualGood, 0
+	}
+	if e, ok := err.(*ResExc); ok {
+		return QualExc, e.ExCode
+	}
+	if e, ok := err.(*ErrChunk); ok {
+		return QualityOf(e.Err)
+	}
+	return QualCommFail, 0
+}
+
+// Deadband configures the report-by-exception filtering of polled
+// values: A value is reported only when it changes by more than the
+// deadband, when its quality changes, or when it has not been
+// reported for MaxSilence.
+//
+// If both Abs and Pct are zero, every change is reported. Otherwise
+// a change is reported if the difference between the new value and
+// the last reported one is larger than Abs (if Abs > 0), or larger
+// than Pct percent of the last reported value (if Pct > 0). For tags
+// with multiple registers, each register is checked individually,
+// and the whole tag is reported if any register exceeds the
+// deadband. Deadbands do not apply to bits (coils and discrete
+// inputs); every change is reported.
+type Deadband struct {
+	// Absolute deadband
+	Abs float64
+	// Percentage deadband (percent of the last reported value)
+	Pct float64
+	// Interpret register values as signed 16-bit integers
+	Signed bool
+	// Report the value, even if unchanged, if it has not been
+	// reported for this long. Zero means never.
+	MaxSilence time.Duration
+}
+
+// regVal returns register value r as a float, interpreted according
+// to db.Signed.
+func (db *Deadband) regVal(r uint16) float64 {
+	if db.Signed {
+		return float64(int16(r))
+	}
+	return float64(r)
+}
+
+// exceeds returns true if the change from register value old to nv
+// should be reported.
+func (db *Deadband) exceeds(old, nv uint16) bool {
+	if old == nv {
+		return false
+	}
+	if db.Abs <= 0 && db.Pct <= 0 {
+		return true
+	}
+	o, n := db.regVal(old), db.regVal(nv)
+	d := math.Abs(n - o)
+	if db.Abs > 0 && d > db.Abs {
+		return true
+	}
+	if db.Pct > 0 && d > math.Abs(o)*db.Pct/100 {
+		return true
+	}
+	return false
+}
+
+// Filter is a report-by-exception filter for the values of a single
+// tag, configured by the embedded Deadband. The Poller uses a Filter
+// for every tag; Filters can also be used directly, with values read
+// by other means. The zero value is a filter that reports every
+// change.
+type Filter struct {
+	Deadband
+	last  PollValue
+	valid bool
+}
+
+// Pass returns true if value v should be reported. If so, v becomes
+// the last reported value. The first value passed is always
+// reported. The quality fields of v (Quality and ExCode) must be set
+// (see QualityOf), and so must be v.Time if MaxSilence is used.
+func (f *Filter) Pass(v PollValue) bool {
+	if !f.valid || f.changed(v) ||
+		(f.MaxSilence > 0 && v.Time.Sub(f.last.Time) >= f.MaxSilence) {
+		f.last, f.valid = v, true
+		return true
+	}
+	return false
+}
+
+// changed returns true if v differs from the last reported value by
+// more than the deadband, or if the quality has changed.
+func (f *Filter) changed(v PollValue) bool {
+	l := f.last
+	if l.Quality != v.Quality || l.ExCode != v.ExCode {
+		return true
+	}
+	if len(l.Regs) != len(v.Regs) || len(l.Bits) != len(v.Bits) {
+		return true
+	}
+	for i := range v.Regs {
+		if f.exceeds(l.Regs[i], v.Regs[i]) {
+			return true
+		}
+	}
+	for i := range v.Bits {
+		if l.Bits[i] != v.Bits[i] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQualityOf(t *testing.T) {
+	tests := []struct {
+		err error
+		q   Quality
+		exc ExCode
+	}{
+		{nil, QualGood, 0},
+		{ErrTimeout, QualCommFail, 0},
+		{ErrCRC, QualCommFail, 0},
+		{&ResExc{Function: RdHoldingRegs, ExCode: BadAddress},
+			QualExc, BadAddress},
+		{&ErrChunk{Err: &ResExc{ExCode: SrvBusy}}, QualExc, SrvBusy},
+	}
+	for _, tst := range tests {
+		q, exc := QualityOf(tst.err)
+		if q != tst.q || exc != tst.exc {
+			t.Fatalf("QualityOf(%v): %d,%s != %d,%s",
+				tst.err, q, exc, tst.q, tst.exc)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	t0 := time.Now()
+	f := Filter{Deadband: Deadband{Abs: 5, Pct: 10, Signed: true,
+		MaxSilence: time.Minute}}
+	tests := []struct {
+		val  uint16
+		q    Quality
+		dt   time.Duration
+		pass bool
+	}{
+		{100, QualGood, 0, true},                  // First value
+		{104, QualGood, 1, false},                 // Within both
+		{106, QualGood, 2, true},                  // Exceeds Abs
+		{0xfffe, QualGood, 3, true},               // -2: Exceeds both
+		{0xfffc, QualGood, 4, true},               // -4: Exceeds Pct
+		{0xfffc, QualCommFail, 5, true},           // Quality changed
+		{0xfffc, QualCommFail, 6, false},          // Unchanged
+		{0xfffc, QualGood, 7, true},               // Quality changed
+		{0xfffc, QualGood, time.Minute, false},    // Silence < MaxSilence
+		{0xfffc, QualGood, time.Minute + 7, true}, // MaxSilence
+	}
+	for i, tst := range tests {
+		v := PollValue{Regs: []uint16{tst.val}, Quality: tst.q,
+			Time: t0.Add(tst.dt)}
+		if f.Pass(v) != tst.pass {
+			t.Fatalf("Test %d: Pass != %v", i, tst.pass)
+		}
+	}
+
+	// Percentage deadband
+	f = Filter{Deadband: Deadband{Pct: 10}}
+	for i, tst := range []struct {
+		val  uint16
+		pass bool
+	}{{1000, true}, {1090, false}, {1101, true}, {1000, false}} {
+		v := PollValue{Regs: []uint16{tst.val}}
+		if f.Pass(v) != tst.pass {
+			t.Fatalf("Pct %d: Pass != %v", i, tst.pass)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Parity is the serial line parity setting
+type Parity byte
+
+const (
+	ParityNone Parity = 'N'
+	ParityEven Parity = 'E'
+	ParityOdd  Parity = 'O'
+)
+
+// LineConf are the serial line settings. Data bits are always 8.
+type LineConf struct {
+	Baudrate int
+	Parity   Parity
+	StopBits int
+}
+
+// String returns the line settings in the usual notation
+// (e.g. "9600-8E1").
+func (lc LineConf) String() string {
+	return fmt.Sprintf("%d-8%c%d", lc.Baudrate, lc.Parity, lc.StopBits)
+}
+
+// CommonBaudrates are the bitrates tried by default by the Detector,
+// in order.
+var CommonBaudrates = []int{9600, 19200, 38400, 115200, 57600,
+	4800, 2400, 1200}
+
+// CommonLineConfs returns the line settings tried by default by the
+// Detector: All CommonBaudrates, each with 8E1 (the modbus default),
+// 8N2, 8N1, and 8O1.
+func CommonLineConfs() []LineConf {
+	var lcs []LineConf
+	for _, br := range CommonBaudrates {
+		lcs = append(lcs,
+			LineConf{br, ParityEven, 1},
+			LineConf{br, ParityNone, 2},
+			LineConf{br, ParityNone, 1},
+			LineConf{br, ParityOdd, 1})
+	}
+	return lcs
+}
+
+// DetectResult is the result of trying a line setting.
+type DetectResult struct {
+	Conf LineConf
+	// Number of CRC-valid frames received.
+	Frames int
+	// Error of the last failed attempt (active detection only).
+	Err error
+}
+
+// Detector finds the settings (bitrate, parity, stop-bits) of a
+// serial modbus bus (RTU encoding). It tries each line setting in
+// turn, by reconfiguring the serial port using function Config.
+//
+// Active detection (method Detect) sends a probe request to a node
+// known to exist, and looks for a CRC-valid reply (normal or
+// exception). Passive detection (method Listen) just listens to the
+// bus traffic (of some other master), and looks for CRC-valid frames.
+//
+// Timeouts for each setting are calculated (with SerBusTime) from the
+// setting's bitrate.
+type Detector struct {
+	// Config configures the serial port with the given settings.
+	Config func(lc LineConf) error
+	// Settings to try, in order. If nil, CommonLineConfs() are
+	// tried.
+	Confs []LineConf
+	// Node to probe, and probe request (active detection). If
+	// Probe is nil, a report-server-id request (ReqSlaveId) is
+	// used.
+	Node  uint8
+	Probe Req
+	// Number of probes per setting (active detection). If zero,
+	// 2 are used.
+	Tries int
+	// Node processing time allowance (active detection), added to
+	// the response timeout. If zero, DflSerMstTimeout is used.
+	Latency time.Duration
+	// Time to listen on each setting (passive detection). If
+	// zero, 2 seconds are used.
+	ListenTime time.Duration
+	// Minimum number of CRC-valid frames required to accept a
+	// setting (passive detection). If zero, 3 are required.
+	MinFrames int
+	// If All is true, all settings are tried. Otherwise detection
+	// stops with the first setting accepted.
+	All bool
+	// Notify, if not nil, is called with the result for every
+	// setting tried.
+	Notify func(r DetectResult)
+
+	port DeadlineReadWriter
+}
+
+// NewDetector returns a detector for the serial bus accessed through
+// port, which is reconfigured using function config.
+func NewDetector(port DeadlineReadWriter,
+	config func(lc LineConf) error) *Detector {
+	return &Detector{port: port, Config: config}
+}
+
+func (d *Detector) confs() []LineConf {
+	if d.Confs != nil {
+		return d.Confs
+	}
+	return CommonLineConfs()
+}
+
+// master returns a master for the port, with timing parameters
+// calculated for the given line setting.
+func (d *Detector) master(lc LineConf) *SerMaster {
+	lat := d.Latency
+	if lat <= 0 {
+		lat = DflSerMstTimeout
+	}
+	rcv := NewSerReceiverRTU(d.port)
+	rcv.FrameTimeout, _ = SerBusTime(lc.Baudrate, 4, 1.0)
+	rcv.SyncDelay, _ = SerBusTime(lc.Baudrate, 8, 1.0)
+	rcv.SyncWaitMax = time.Second
+	trx := NewSerTransmitterRTU(d.port)
+	trx.Baudrate = lc.Baudrate
+	trx.Delay, _ = SerBusTime(lc.Baudrate, 4, 1.0)
+	sm := NewSerMaster(rcv, trx)
+	tmo, _ := SerBusTime(lc.Baudrate, MaxSerADU, 1.0)
+	sm.Timeout = tmo + lat
+	return sm
+}
+
+// detectFatal returns true if err does not allow detection to continue
+func detectFatal(err error) bool {
+	if _, ok := err.(*ErrIO); ok {
+		return true
+	}
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// Detect performs active detection. It returns the results for the
+// settings under which a valid reply to the probe was received. If
+// ctx is done, or if Config fails, or on I/O errors, it returns the
+// results so far, along with the error.
+func (d *Detector) Detect(ctx context.Context) ([]DetectResult, error) {
+	probe := d.Probe
+	if probe == nil {
+		probe = &ReqSlaveId{}
+	}
+	tries := d.Tries
+	if tries <= 0 {
+		tries = 2
+	}
+	var rs []DetectResult
+	for _, lc := range d.confs() {
+		if err := ctx.Err(); err != nil {
+			return rs, err
+		}
+		if err := d.Config(lc); err != nil {
+			return rs, err
+		}
+		sm := d.master(lc)
+		r := DetectResult{Conf: lc}
+		for i := 0; i < tries; i++ {
+			_, err := sm.DoContext(ctx, d.Node, probe, nil)
+			if _, ok := err.(*ResExc); ok || err == nil {
+				r.Frames, r.Err = 1, nil
+				break
+			}
+			if detectFatal(err) {
+				return rs, err
+			}
+			r.Err = err
+		}
+		if d.Notify != nil {
+			d.Notify(r)
+		}
+		if r.Frames > 0 {
+			rs = append(rs, r)
+			if !d.All {
+				break
+			}
+		}
+	}
+	return rs, nil
+}
+
+// frameLen returns the length of the (request, if req is true, or
+// response) serial frame at the beginning of b. It returns 0 if the
+// frame size cannot be determined, and -1 if b does not hold enough
+// bytes. Frames that end at silence (see sizer) are taken to end at
+// the first CRC-valid length.
+func frameLen(b []byte, req bool) int {
+	var sz sizer
+	n := 0
+	for {
+		var rem int
+		var ok bool
+		if req {
+			rem, ok = sz.sizeReq(b[:n])
+		} else {
+			rem, ok = sz.sizeRes(b[:n])
+		}
+		if !ok {
+			return 0
+		}
+		if sz.atSilence(b[:n]) {
+			for l := n; l <= len(b) && l <= MaxSerADU; l++ {
+				if SerADU(b[:l]).CheckCRC() {
+					return l
+				}
+			}
+			if len(b) >= MaxSerADU {
+				return 0
+			}
+			return -1
+		}
+		if rem <= 0 {
+			return n + rem
+		}
+		n += rem
+		if n > MaxSerADU {
+			return 0
+		}
+		if n > len(b) {
+			return -1
+		}
+	}
+}
+
+// countFrames returns the number of CRC-valid frames (requests or
+// responses) found in b, and the offset in b where the last of them
+// ends (zero if none was found).
+func countFrames(b []byte) (nf, end int) {
+	for i := 0; i < len(b); {
+		n := 0
+		for _, req := range []bool{true, false} {
+			l := frameLen(b[i:], req)
+			if l >= SerHeadSz+1+SerCRCSz && b[i] <= 247 &&
+				SerADU(b[i:i+l]).CheckCRC() {
+				n = l
+				break
+			}
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		nf++
+		i += n
+		end = i
+	}
+	return nf, end
+}
+
+// Listen performs passive detection. It returns the results for the
+// settings under which at least MinFrames CRC-valid frames were
+// received. If ctx is done, or if Config fails, or on I/O errors, it
+// returns the results so far, along with the error.
+func (d *Detector) Listen(ctx context.Context) ([]DetectResult, error) {
+	lt := d.ListenTime
+	if lt <= 0 {
+		lt = 2 * time.Second
+	}
+	minFrames := d.MinFrames
+	if minFrames <= 0 {
+		minFrames = 3
+	}
+	var rs []DetectResult
+	buf := make([]byte, 0, 4096)
+	for _, lc := range d.confs() {
+		if err := ctx.Err(); err != nil {
+			return rs, err
+		}
+		if err := d.Config(lc); err != nil {
+			return rs, err
+		}
+		buf = buf[:0]
+		nf := 0
+		tend := time.Now().Add(lt)
+		for time.Now().Before(tend) && ctx.Err() == nil {
+			if len(buf) == cap(buf) {
+				// Keep what follows the last complete frame;
+				// it may hold a partial one. A frame cannot
+				// start more than MaxSerADU bytes before the
+				// end and still be partial.
+				n, end := countFrames(buf)
+				nf += n
+				if l := len(buf) - MaxSerADU; end < l {
+					end = l
+				}
+				buf = append(buf[:0], buf[end:]...)
+			}
+			dl := time.Now().Add(100 * time.Millisecond)
+			if dl.After(tend) {
+				dl = tend
+			}
+			d.port.SetReadDeadline(dl)
+			n, err := d.port.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err != nil && !IsTimeout(err) {
+				return rs, wErrIO(err)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return rs, err
+		}
+		n, _ := countFrames(buf)
+		nf += n
+		r := DetectResult{Conf: lc, Frames: nf}
+		if d.Notify != nil {
+			d.Notify(r)
+		}
+		if nf >= minFrames {
+			rs = append(rs, r)
+			if !d.All {
+				break
+			}
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDetect(t *testing.T) {
+	target := LineConf{19200, ParityNone, 2}
+	var cur LineConf
+	dev := &testDev{node: 0x11}
+	p := &testSerPort{reply: func(a SerADU) []byte {
+		if cur != target {
+			return nil
+		}
+		return dev.reply(a)
+	}}
+	var tried int
+	d := NewDetector(p, func(lc LineConf) error {
+		cur = lc
+		return nil
+	})
+	d.Node = 0x11
+	d.Tries = 1
+	d.Latency = time.Millisecond
+	d.Notify = func(r DetectResult) { tried++ }
+
+	rs, err := d.Detect(context.Background())
+	if err != nil {
+		t.Fatalf("Detect: %s", err)
+	}
+	if len(rs) != 1 || rs[0].Conf != target || rs[0].Conf.String() != "19200-8N2" {
+		t.Fatalf("Bad results: %+v", rs)
+	}
+	if tried != 6 {
+		t.Fatalf("Expected 6 settings tried, got %d", tried)
+	}
+}
+
+func TestDetectListen(t *testing.T) {
+	target := LineConf{9600, ParityOdd, 1}
+	var frames []byte
+	for i := 0; i < 4; i++ {
+		req, _ := SerPack(nil, 0x05, &ReqRdRegs{Holding: true,
+			Addr: uint16(i), Num: 2})
+		res, _ := SerPack(nil, 0x05, &ResRdRegs{Holding: true,
+			Val: []uint16{uint16(i), 0x1234}})
+		frames = append(frames, req...)
+		frames = append(frames, res...)
+	}
+	noise := make([]byte, 200)
+	for i := range noise {
+		noise[i] = byte(i*37 + 11)
+	}
+	p := &testSerPort{}
+	d := NewDetector(p, func(lc LineConf) error {
+		if lc == target {
+			p.Inject(frames)
+		} else {
+			p.Inject(noise)
+		}
+		return nil
+	})
+	d.Confs = []LineConf{{9600, ParityEven, 1}, {9600, ParityNone, 2},
+		target, {19200, ParityEven, 1}}
+	d.ListenTime = 20 * time.Millisecond
+	d.All = true
+	rs, err := d.Listen(context.Background())
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	if len(rs) != 1 || rs[0].Conf != target || rs[0].Frames != 8 {
+		t.Fatalf("Bad results: %+v", rs)
+	}
+}
+
+func TestDetectListenLong(t *testing.T) {
+	// More frames than fit in Listen's buffer
+	var frames []byte
+	nf := 0
+	for len(frames) < 3*4096 {
+		req, _ := SerPack(nil, 0x05, &ReqRdRegs{Holding: true,
+			Addr: uint16(nf), Num: 2})
+		res, _ := SerPack(nil, 0x05, &ResRdRegs{Holding: true,
+			Val: []uint16{uint16(nf), 0x1234}})
+		frames = append(frames, req...)
+		frames = append(frames, res...)
+		nf += 2
+	}
+	p := &testSerPort{}
+	d := NewDetector(p, func(lc LineConf) error {
+		p.Inject(frames)
+		return nil
+	})
+	d.Confs = []LineConf{{9600, ParityEven, 1}}
+	d.ListenTime = 20 * time.Millisecond
+	rs, err := d.Listen(context.Background())
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	if len(rs) != 1 || rs[0].Frames != nf {
+		t.Fatalf("Bad results (expected %d frames): %+v", nf, rs)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+// Standard device identification object ids. See [1],§6.21,pg.44
+const (
+	DevIdVendorName          uint8 = 0x00 // Basic
+	DevIdProductCode         uint8 = 0x01 // Basic
+	DevIdMajorMinorRevision  uint8 = 0x02 // Basic
+	DevIdVendorUrl           uint8 = 0x03 // Regular
+	DevIdProductName         uint8 = 0x04 // Regular
+	DevIdModelName           uint8 = 0x05 // Regular
+	DevIdUserApplicationName uint8 = 0x06 // Regular
+)
+
+// DevIdent is the identity of a slave device, as reported in response
+// to report-server-id (ReqSlaveId) and read-device-identification
+// (ReqRdDevId) requests.
+type DevIdent struct {
+	// Server id, run-indicator status, and additional data,
+	// returned in response to report-server-id requests. If nil,
+	// report-server-id requests are not answered.
+	SlaveId []byte
+	// Device identification objects, sorted by id. Objects with
+	// ids 0x00 to 0x02 are basic, 0x03 to 0x7f regular, and 0x80 to
+	// 0xff extended. If nil, read-device-identification requests
+	// are not answered.
+	Objs []DevIdObj
+}
+
+// conformity returns the conformity level of the identification
+// objects. Individual access is always supported.
+func (id *DevIdent) conformity() uint8 {
+	lvl := DevIdBasic
+	for _, o := range id.Objs {
+		switch {
+		case o.Id >= 0x80:
+			lvl = DevIdExtended
+		case o.Id >= 0x03 && lvl < DevIdRegular:
+			lvl = DevIdRegular
+		}
+	}
+	return 0x80 | lvl
+}
+
+// rdDevId answers read-device-identification request r.
+func (id *DevIdent) rdDevId(r *ReqRdDevId) Res {
+	exc := func(ec ExCode) Res {
+		return &ResExc{Function: RdDevId, ExCode: ec}
+	}
+	res := &ResRdDevId{Code: r.Code, Conformity: id.conformity()}
+	if r.Code == DevIdIndividual {
+		for _, o := range id.Objs {
+			if o.Id == r.ObjId {
+				res.Objs = []DevIdObj{o}
+				return res
+			}
+		}
+		return exc(BadAddress)
+	}
+	var last uint8
+	switch r.Code {
+	case DevIdBasic:
+		last = 0x02
+	case DevIdRegular:
+		last = 0x7f
+	case DevIdExtended:
+		last = 0xff
+	default:
+		return exc(BadValue)
+	}
+	// Objects in the requested category
+	var objs []DevIdObj
+	for _, o := range id.Objs {
+		if o.Id <= last {
+			objs = append(objs, o)
+		}
+	}
+	// Start at ObjId; if it does not exist, start from the
+	// beginning.
+	for i, o := range objs {
+		if o.Id == r.ObjId {
+			objs = objs[i:]
+			break
+		}
+	}
+	// Return as many objects as fit in the response
+	room := MaxPDU - 7
+	for i, o := range objs {
+		if room < 2+len(o.Val) && i > 0 {
+			res.More, res.NextObj = true, o.Id
+			break
+		}
+		room -= 2 + len(o.Val)
+		res.Objs = append(res.Objs, o)
+	}
+	return res
+}
+
+// Handle answers report-server-id and read-device-identification
+// requests, according to the device identity. It returns nil for
+// other requests, and for requests not answered (see fields SlaveId
+// and Objs).
+func (id *DevIdent) Handle(node uint8, req Req) Res {
+	switch r := req.(type) {
+	case *ReqSlaveId:
+		if id.SlaveId == nil {
+			return nil
+		}
+		return &ResSlaveId{Data: id.SlaveId}
+	case *ReqRdDevId:
+		if id.Objs == nil {
+			return nil
+		}
+		return id.rdDevId(r)
+	}
+	return nil
+}
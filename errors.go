@@ -82,11 +82,11 @@ func IsTimeout(e error) bool {
 
 // IsTemporary, tests if error is temporary
 func IsTemporary(e error) bool {
-	type tmoError interface {
-		Timeout() bool
+	type tmpError interface {
+		Temporary() bool
 	}
-	if et, ok := e.(tmoError); ok {
-		return et.Timeout()
+	if et, ok := e.(tmpError); ok {
+		return et.Temporary()
 	}
 	return false
 }
@@ -126,4 +126,17 @@ var (
 	// Errors returned by the serial master
 	ErrRequest  = newErr("Bad or invalid request")
 	ErrResponse = newErr("Bad or invalid response")
+	ErrOffline  = mkErr(efCom|efTmp, "Node offline")
+
+	// Errors returned by the TCP master
+	ErrConnLost = mkErr(efCom|efTmp, "Connection lost")
+	ErrNoConn   = mkErr(efCom|efTmp, "Not connected")
+	ErrClosed   = newErr("Master closed")
+
+	// Errors returned by slave data models and multiplexers
+	ErrAddress = newErr("Bad or invalid address")
+	ErrNode    = newErr("Bad or unavailable node id")
+
+	// Errors returned by the serial bus arbiter
+	ErrDeadline = mkErr(efTmo|efTmp, "Deadline exceeded")
 )
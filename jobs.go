@@ -0,0 +1,161 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import "sync"
+
+// ResAck is returned by slave handlers to acknowledge a request that
+// starts a long operation (job), which cannot complete before the
+// master times-out. A JobRunner answers such requests with SrvAck
+// exceptions, and runs Job in the background. Returned by a handler
+// not wrapped by a JobRunner, ResAck is a plain SrvAck exception
+// response, and Job is not run.
+type ResAck struct {
+	ResExc
+	// Job performs the operation, and returns an exception code
+	// (zero on success).
+	Job func() ExCode
+}
+
+// Ack returns a ResAck response to request req, for the operation
+// performed by job.
+func Ack(req Req, job func() ExCode) *ResAck {
+	return &ResAck{ResExc: ResExc{Function: req.FnCode(), ExCode: SrvAck},
+		Job: job}
+}
+
+// asExc returns the exception response res (nil and false if res is
+// not an exception response). Unwraps ResAck responses.
+func asExc(res Res) (*ResExc, bool) {
+	switch r := res.(type) {
+	case *ResExc:
+		return r, true
+	case *ResAck:
+		return &r.ResExc, true
+	}
+	return nil, false
+}
+
+// Job states, reported by JobRunner.Status and in the status register
+const (
+	JobIdle    uint16 = 0 // No job has run
+	JobRunning uint16 = 1 // A job is running
+	JobDone    uint16 = 2 // Last job completed successfully
+	JobFailed  uint16 = 3 // Last job failed
+)
+
+// StatusReg is the address of a status register.
+type StatusReg struct {
+	// Holding (if true) or input register
+	Holding bool
+	Addr    uint16
+}
+
+// JobRunner is a SerHandler that wraps handler Handler, and runs the
+// jobs it starts (see ResAck). While a job runs, requests are answered
+// with SrvBusy exceptions, except for reads of the status register.
+// Only one job runs at a time.
+//
+// The status register (if StatusReg is not nil) is answered by the
+// runner itself, at any time (requests must read just this
+// register). Its value has the job state (JobXXX constants) in the
+// low byte, and, if the job failed, the exception code it failed
+// with in the high byte. Masters can poll it to learn when a job has
+// completed.
+//
+// The runner must wrap the handler that returns ResAck responses, and
+// any middlewares between the two must pass ResAck responses
+// unchanged (all middlewares in this package do). That is, chain the
+// middlewares inside the runner, like NewJobRunner(Chain(h, mw...)),
+// or outside it, like Chain(jr, mw...). Middlewares inside the runner
+// see ResAck responses, which they treat as SrvAck exceptions;
+// middlewares outside it see the SrvAck and SrvBusy exceptions the
+// runner replies with (*ResExc).
+type JobRunner struct {
+	Handler   SerHandler
+	StatusReg *StatusReg
+
+	mu    sync.Mutex
+	state uint16
+	ec    ExCode
+	done  chan struct{}
+}
+
+// NewJobRunner returns a JobRunner wrapping handler h.
+func NewJobRunner(h SerHandler) *JobRunner {
+	return &JobRunner{Handler: h}
+}
+
+// Status returns the state of the last job (JobXXX constants), and
+// the exception code it failed with (if state is JobFailed). It is ok
+// to call it while the runner is being used by a slave.
+func (jr *JobRunner) Status() (state uint16, ec ExCode) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	return jr.state, jr.ec
+}
+
+// Wait returns a channel that is closed when no job is running.
+func (jr *JobRunner) Wait() <-chan struct{} {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if jr.state != JobRunning {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	return jr.done
+}
+
+// statusReq returns true if req reads (just) the status register.
+func (jr *JobRunner) statusReq(req Req) bool {
+	r, ok := req.(*ReqRdRegs)
+	return ok && jr.StatusReg != nil && r.Holding == jr.StatusReg.Holding &&
+		r.Addr == jr.StatusReg.Addr && r.Num == 1
+}
+
+// run runs job, and records its outcome.
+func (jr *JobRunner) run(job func() ExCode) {
+	ec := job()
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	jr.state, jr.ec = JobDone, 0
+	if ec != 0 {
+		jr.state, jr.ec = JobFailed, ec
+	}
+	close(jr.done)
+}
+
+// Handle handles request req. See type JobRunner.
+func (jr *JobRunner) Handle(node uint8, req Req) Res {
+	jr.mu.Lock()
+	if jr.statusReq(req) {
+		st := jr.state | uint16(jr.ec)<<8
+		jr.mu.Unlock()
+		return &ResRdRegs{Holding: jr.StatusReg.Holding, Val: []uint16{st}}
+	}
+	if jr.state == JobRunning {
+		jr.mu.Unlock()
+		return excRes(req, SrvBusy)
+	}
+	jr.mu.Unlock()
+	res := jr.Handler.Handle(node, req)
+	a, ok := res.(*ResAck)
+	if !ok || a.Job == nil {
+		return res
+	}
+	jr.mu.Lock()
+	if jr.state == JobRunning {
+		// Another job started meanwhile
+		jr.mu.Unlock()
+		return excRes(req, SrvBusy)
+	}
+	jr.state, jr.ec = JobRunning, 0
+	jr.done = make(chan struct{})
+	jr.mu.Unlock()
+	go jr.run(a.Job)
+	return excRes(req, SrvAck)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobRunner(t *testing.T) {
+	dm := NewDataModel(AddrRange{}, AddrRange{}, AddrRange{0, 10}, AddrRange{})
+	release := make(chan ExCode)
+	// Writing register 100 starts a job, which completes with the
+	// exception code sent to release.
+	h := SerHandlerFunc(func(node uint8, req Req) Res {
+		if r, ok := req.(*ReqResWrReg); ok && r.Addr == 100 {
+			return Ack(req, func() ExCode { return <-release })
+		}
+		return dm.Handle(node, req)
+	})
+	jr := NewJobRunner(h)
+	jr.StatusReg = &StatusReg{Holding: true, Addr: 200}
+	c := NewClient(handlerDoer{jr})
+	status := func() uint16 {
+		v, err := c.ReadHoldingRegisters(1, 200, 1)
+		if err != nil {
+			t.Fatalf("Read status: %s", err)
+		}
+		return v[0]
+	}
+
+	if st := status(); st != JobIdle {
+		t.Fatalf("Initial status: %#04x", st)
+	}
+	for i, ec := range []ExCode{0, SrvFail} {
+		if err := c.WriteSingleRegister(1, 100, 1); !isExc(err, SrvAck) {
+			t.Fatalf("%d: Expected SrvAck, got: %v", i, err)
+		}
+		if st := status(); st != JobRunning {
+			t.Fatalf("%d: Status while running: %#04x", i, st)
+		}
+		if _, err := c.ReadHoldingRegisters(1, 0, 1); !isExc(err, SrvBusy) {
+			t.Fatalf("%d: Expected SrvBusy, got: %v", i, err)
+		}
+		release <- ec
+		select {
+		case <-jr.Wait():
+		case <-time.After(time.Second):
+			t.Fatalf("%d: Job did not complete", i)
+		}
+		exp := JobDone
+		if ec != 0 {
+			exp = JobFailed | uint16(ec)<<8
+		}
+		if st := status(); st != exp {
+			t.Fatalf("%d: Status after job: %#04x", i, st)
+		}
+		if _, err := c.ReadHoldingRegisters(1, 0, 1); err != nil {
+			t.Fatalf("%d: Read after job: %s", i, err)
+		}
+	}
+	if state, ec := jr.Status(); state != JobFailed || ec != SrvFail {
+		t.Fatalf("Status: %d, %s", state, ec)
+	}
+}
+
+func TestJobRunnerMiddleware(t *testing.T) {
+	h := SerHandlerFunc(func(node uint8, req Req) Res {
+		return Ack(req, func() ExCode { return 0 })
+	})
+	var logs []string
+	logf := func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+	var m HandlerMetrics
+	// Middlewares inside the runner see ResAck
+	jr := NewJobRunner(Chain(h, m.Wrap, Logger(logf)))
+	c := NewClient(handlerDoer{jr})
+	if err := c.WriteSingleRegister(1, 100, 1); !isExc(err, SrvAck) {
+		t.Fatalf("Expected SrvAck, got: %v", err)
+	}
+	<-jr.Wait()
+	// Without a runner, ResAck is a plain SrvAck exception
+	c = NewClient(handlerDoer{Chain(h, m.Wrap, Logger(logf))})
+	if err := c.WriteSingleRegister(1, 100, 1); !isExc(err, SrvAck) {
+		t.Fatalf("Expected SrvAck, got: %v", err)
+	}
+	if st := m.Stats(); st.Exc[SrvAck] != 2 {
+		t.Fatalf("Stats: %+v", st)
+	}
+	for _, l := range logs {
+		if !strings.Contains(l, "exception") {
+			t.Fatalf("Not logged as exception: %q", l)
+		}
+	}
+}
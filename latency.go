@@ -0,0 +1,171 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"sort"
+	"time"
+)
+
+// Number of most-recent response latency samples kept per node, for
+// computing latency statistics.
+const LatencySamples = 128
+
+// LatencyBuckets are the upper bounds of the buckets of the latency
+// histogram (see LatencyStats.Hist). Latencies larger than the last
+// bound are counted in an additional, last, bucket.
+var LatencyBuckets = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1000 * time.Millisecond,
+}
+
+// latencyBucket returns the histogram bucket for latency d.
+func latencyBucket(d time.Duration) int {
+	for i, b := range LatencyBuckets {
+		if d <= b {
+			return i
+		}
+	}
+	return len(LatencyBuckets)
+}
+
+// LatencyStats are response latency statistics for a node. Latency is
+// measured from the (approx.) end of the request transmission, until
+// the reception of the first response byte. Min, Max, P50, and P99
+// are computed over the last LatencySamples samples. Responses that
+// timed out are not counted as samples, but are counted in Timeouts.
+type LatencyStats struct {
+	// Number of samples (responses received), in total.
+	N uint64
+	// Number of response timeouts, in total.
+	Timeouts uint64
+	Min      time.Duration
+	Max      time.Duration
+	P50      time.Duration
+	P99      time.Duration
+	// Histogram of all the responses received, by latency. Hist[i]
+	// counts the responses with latency up to LatencyBuckets[i]
+	// (and larger than LatencyBuckets[i-1]).
+	Hist [len(LatencyBuckets) + 1]uint64
+}
+
+// AdaptTimeout configures the derivation of per-node response
+// timeouts from latency statistics (see SerMaster.Adapt). Once at
+// least MinSamples responses have been received from a node, its
+// response timeout becomes P99 * Factor, clamped to [Min, Max].
+//
+// When a response times out, the timeout used (but no less than
+// SerMinTimeout) is recorded as a sample for the derivation (but not
+// in the node's LatencyStats). This way the timeout of a node that
+// has become slower grows, with consecutive timeouts, until its
+// responses are received again.
+type AdaptTimeout struct {
+	// Multiplier applied to the 99th-percentile latency. If
+	// zero, 2 is used.
+	Factor float64
+	// Minimum and maximum timeouts. If Min is zero,
+	// SerMinTimeout is used. If Max is zero, the master's Timeout
+	// is used.
+	Min time.Duration
+	Max time.Duration
+	// Samples required before adapting. If zero, 16 is used.
+	MinSamples int
+}
+
+// timeout returns the timeout derived from latency statistics st. If
+// there are not enough samples, it returns dfl.
+func (at *AdaptTimeout) timeout(st *latency, dfl time.Duration) time.Duration {
+	minSamples := at.MinSamples
+	if minSamples <= 0 {
+		minSamples = 16
+	}
+	if st.nsmpl < minSamples {
+		return dfl
+	}
+	factor := at.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+	max := at.Max
+	if max <= 0 {
+		max = dfl
+	}
+	min := at.Min
+	if min <= 0 {
+		min = SerMinTimeout
+	}
+	tmo := time.Duration(float64(st.pct(99)) * factor)
+	if tmo < min {
+		tmo = min
+	}
+	if tmo > max {
+		tmo = max
+	}
+	return tmo
+}
+
+// latency keeps response latency samples for a node, in a ring buffer.
+type latency struct {
+	n        uint64
+	timeouts uint64
+	hist     [len(LatencyBuckets) + 1]uint64
+	smpl     [LatencySamples]time.Duration
+	nsmpl    int
+	next     int
+	sorted   []time.Duration // cached, nil if stale
+}
+
+// add records latency sample d.
+func (l *latency) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	l.smpl[l.next] = d
+	l.next = (l.next + 1) % LatencySamples
+	if l.nsmpl < LatencySamples {
+		l.nsmpl++
+	}
+	l.sorted = nil
+}
+
+// pct returns the p-th percentile of the samples (zero if there are
+// no samples).
+func (l *latency) pct(p int) time.Duration {
+	if l.nsmpl == 0 {
+		return 0
+	}
+	if l.sorted == nil {
+		l.sorted = append([]time.Duration(nil), l.smpl[:l.nsmpl]...)
+		sort.Slice(l.sorted, func(i, j int) bool {
+			return l.sorted[i] < l.sorted[j]
+		})
+	}
+	i := (l.nsmpl*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return l.sorted[i]
+}
+
+// stats returns the latency statistics.
+func (l *latency) stats() LatencyStats {
+	st := LatencyStats{N: l.n, Timeouts: l.timeouts, Hist: l.hist}
+	if l.nsmpl > 0 {
+		st.Min = l.pct(0)
+		st.Max = l.pct(100)
+		st.P50 = l.pct(50)
+		st.P99 = l.pct(99)
+	}
+	return st
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	var l latency
+	for i := 1; i <= 100; i++ {
+		l.n++
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	st := l.stats()
+	if st.N != 100 || st.Min != time.Millisecond ||
+		st.Max != 100*time.Millisecond ||
+		st.P50 != 50*time.Millisecond ||
+		st.P99 != 99*time.Millisecond {
+		t.Fatalf("Bad stats: %+v", st)
+	}
+	// Overflow the ring; only the last samples count.
+	for i := 0; i < LatencySamples; i++ {
+		l.add(time.Millisecond)
+	}
+	if st = l.stats(); st.Max != time.Millisecond {
+		t.Fatalf("Old samples not discarded: %+v", st)
+	}
+
+	at := &AdaptTimeout{Factor: 3, Min: 5 * time.Millisecond,
+		MinSamples: 10}
+	if tmo := at.timeout(&l, time.Second); tmo != 5*time.Millisecond {
+		t.Fatalf("Expected Min timeout, got %s", tmo)
+	}
+	var l1 latency
+	l1.add(time.Millisecond)
+	if tmo := at.timeout(&l1, time.Second); tmo != time.Second {
+		t.Fatalf("Adapted with too few samples: %s", tmo)
+	}
+}
+
+func TestSerMasterAdapt(t *testing.T) {
+	var p *testSerPort
+	p = &testSerPort{reply: func(a SerADU) []byte {
+		r := testEcho(a)
+		if a.Node() == 0x02 {
+			// Slow node
+			go func() {
+				time.Sleep(30 * time.Millisecond)
+				p.Inject(r)
+			}()
+			return nil
+		}
+		return r
+	}}
+	sm := newTestSerMaster(p)
+	sm.Timeout = 100 * time.Millisecond
+	sm.Adapt = &AdaptTimeout{Min: 5 * time.Millisecond, MinSamples: 4}
+
+	for i := 0; i < 4; i++ {
+		for _, node := range []uint8{0x01, 0x02} {
+			if _, err := sm.Do(node, &ReqResWrReg{}, nil); err != nil {
+				t.Fatalf("Node %d: %s", node, err)
+			}
+		}
+	}
+	st1, st2 := sm.Latency(0x01), sm.Latency(0x02)
+	if st1.N != 4 || st2.N != 4 || st2.P50 <= st1.P50 {
+		t.Fatalf("Bad stats: %+v, %+v", st1, st2)
+	}
+	tmo1, tmo2 := sm.NodeTimeout(0x01), sm.NodeTimeout(0x02)
+	if tmo1 != 5*time.Millisecond || tmo2 <= tmo1 || tmo2 > sm.Timeout {
+		t.Fatalf("Bad timeouts: %s, %s", tmo1, tmo2)
+	}
+	if tmo := sm.NodeTimeout(0x03); tmo != sm.Timeout {
+		t.Fatalf("Bad timeout for unknown node: %s", tmo)
+	}
+
+	sm.SetNodeTimeout(0x01, 50*time.Millisecond)
+	if tmo := sm.NodeTimeout(0x01); tmo != 50*time.Millisecond {
+		t.Fatalf("Override not honored: %s", tmo)
+	}
+	sm.SetNodeTimeout(0x01, 0)
+	if tmo := sm.NodeTimeout(0x01); tmo != tmo1 {
+		t.Fatalf("Override not removed: %s", tmo)
+	}
+}
+
+func TestSerMasterTimeoutStats(t *testing.T) {
+	var mute bool
+	p := &testSerPort{reply: func(a SerADU) []byte {
+		if mute {
+			return nil
+		}
+		return testEcho(a)
+	}}
+	sm := newTestSerMaster(p)
+	sm.Timeout = 20 * time.Millisecond
+	sm.Adapt = &AdaptTimeout{Min: 5 * time.Millisecond, MinSamples: 4}
+
+	for i := 0; i < 4; i++ {
+		if _, err := sm.Do(0x01, &ReqResWrReg{}, nil); err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+	}
+	st := sm.Latency(0x01)
+	tmo := sm.NodeTimeout(0x01)
+	mute = true
+	for i := 0; i < 4; i++ {
+		if _, err := sm.Do(0x01, &ReqResWrReg{}, nil); err != ErrTimeout {
+			t.Fatalf("Expected ErrTimeout, got: %v", err)
+		}
+	}
+	st1 := sm.Latency(0x01)
+	if st1.N != st.N || st1.P99 != st.P99 || st1.Max != st.Max ||
+		st1.Hist != st.Hist || st1.Timeouts <= st.Timeouts {
+		t.Fatalf("Timeouts counted as samples: %+v, %+v", st, st1)
+	}
+	if tmo1 := sm.NodeTimeout(0x01); tmo1 <= tmo {
+		t.Fatalf("Timeout not adapted: %s <= %s", tmo1, tmo)
+	}
+}
+
+func TestSerMasterAdaptZeroLatency(t *testing.T) {
+	var p *testSerPort
+	var slow bool
+	p = &testSerPort{reply: func(a SerADU) []byte {
+		r := testEcho(a)
+		if slow {
+			// Respond after the transmission deadline
+			go func() {
+				time.Sleep(SerMinTimeout + 10*time.Millisecond)
+				p.Inject(r)
+			}()
+			return nil
+		}
+		return r
+	}}
+	sm := newTestSerMaster(p)
+	sm.Timeout = 200 * time.Millisecond
+	sm.Adapt = &AdaptTimeout{MinSamples: 4}
+
+	// Responses arrive before the transmission deadline: Zero
+	// latency.
+	for i := 0; i < 8; i++ {
+		if _, err := sm.Do(0x01, &ReqResWrReg{}, nil); err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+	}
+	if st := sm.Latency(0x01); st.P99 != 0 {
+		t.Fatalf("Expected zero latency: %+v", st)
+	}
+	if tmo := sm.NodeTimeout(0x01); tmo != SerMinTimeout {
+		t.Fatalf("Expected SerMinTimeout, got %s", tmo)
+	}
+
+	// The node becomes slower. With a (too) small Min requests
+	// time out, but the timeout recovers.
+	slow = true
+	sm.Adapt.Min = time.Nanosecond
+	var err error
+	for i := 0; i < 4; i++ {
+		if _, err = sm.Do(0x01, &ReqResWrReg{}, nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Timeout did not recover: %v (%s)",
+			err, sm.NodeTimeout(0x01))
+	}
+	if st := sm.Latency(0x01); st.Timeouts == 0 {
+		t.Fatalf("Expected timeouts: %+v", st)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SerHandlerFunc is an adapter that allows the use of ordinary
+// functions as slave handlers.
+type SerHandlerFunc func(node uint8, req Req) Res
+
+// Handle calls f(node, req).
+func (f SerHandlerFunc) Handle(node uint8, req Req) Res {
+	return f(node, req)
+}
+
+// Middleware wraps a slave handler, adding functionality to it
+// (logging, access control, etc). Handlers, and therefore
+// middlewares, do not depend on the transport; they can be used by
+// servers of any transport.
+type Middleware func(h SerHandler) SerHandler
+
+// Chain returns handler h wrapped by middlewares mw. The first
+// middleware is the outermost: Requests pass through mw[0], mw[1],
+// ..., and then reach h.
+func Chain(h SerHandler, mw ...Middleware) SerHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// excRes returns an exception response to req, with code ec.
+func excRes(req Req, ec ExCode) Res {
+	return &ResExc{Function: req.FnCode(), ExCode: ec}
+}
+
+// Logger returns a middleware that logs every request and its outcome
+// (response, exception, or no response), using logf (e.g. log.Printf).
+func Logger(logf func(format string, v ...interface{})) Middleware {
+	return func(h SerHandler) SerHandler {
+		return SerHandlerFunc(func(node uint8, req Req) Res {
+			start := time.Now()
+			res := h.Handle(node, req)
+			d := time.Since(start)
+			e, exc := asExc(res)
+			switch {
+			case res == nil:
+				logf("modbus: node %d: %s: no response (%s)",
+					node, req.FnCode(), d)
+			case exc:
+				logf("modbus: node %d: %s: exception %s (%s)",
+					node, req.FnCode(), e.ExCode, d)
+			default:
+				logf("modbus: node %d: %s: ok (%s)",
+					node, req.FnCode(), d)
+			}
+			return res
+		})
+	}
+}
+
+// AllowFns returns a middleware that passes only requests for the
+// given functions to the handler. Other requests are answered with
+// BadFnCode exceptions.
+func AllowFns(fns ...FnCode) Middleware {
+	allow := make(map[FnCode]bool, len(fns))
+	for _, f := range fns {
+		allow[f] = true
+	}
+	return func(h SerHandler) SerHandler {
+		return SerHandlerFunc(func(node uint8, req Req) Res {
+			if !allow[req.FnCode()] {
+				return excRes(req, BadFnCode)
+			}
+			return h.Handle(node, req)
+		})
+	}
+}
+
+// RateLimit returns a middleware that limits the rate of requests
+// passed to the handler to rate requests per second, with bursts of
+// up to burst requests. Requests exceeding the limit are answered with
+// SrvBusy exceptions (broadcasts are dropped).
+func RateLimit(rate float64, burst int) Middleware {
+	if burst < 1 {
+		burst = 1
+	}
+	var mu sync.Mutex
+	tokens := float64(burst)
+	last := time.Now()
+	take := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		tokens += now.Sub(last).Seconds() * rate
+		last = now
+		if tokens > float64(burst) {
+			tokens = float64(burst)
+		}
+		if tokens < 1 {
+			return false
+		}
+		tokens--
+		return true
+	}
+	return func(h SerHandler) SerHandler {
+		return SerHandlerFunc(func(node uint8, req Req) Res {
+			if !take() {
+				if node == 0 {
+					return nil
+				}
+				return excRes(req, SrvBusy)
+			}
+			return h.Handle(node, req)
+		})
+	}
+}
+
+// Record returns a middleware that calls f with every request and
+// the handler's response to it (nil if there was none). Requests and
+// responses must not be modified.
+func Record(f func(node uint8, req Req, res Res)) Middleware {
+	return func(h SerHandler) SerHandler {
+		return SerHandlerFunc(func(node uint8, req Req) Res {
+			res := h.Handle(node, req)
+			f(node, req, res)
+			return res
+		})
+	}
+}
+
+// Delay returns a middleware that delays every request by d, before
+// passing it to the handler. Useful for testing masters against slow
+// slaves.
+func Delay(d time.Duration) Middleware {
+	return func(h SerHandler) SerHandler {
+		return SerHandlerFunc(func(node uint8, req Req) Res {
+			time.Sleep(d)
+			return h.Handle(node, req)
+		})
+	}
+}
+
+// InjectExc returns a middleware that answers requests, with
+// probability p (0 to 1), with exceptions with code ec, instead of
+// passing them to the handler. Useful for testing masters' error
+// handling.
+func InjectExc(p float64, ec ExCode) Middleware {
+	return func(h SerHandler) SerHandler {
+		return SerHandlerFunc(func(node uint8, req Req) Res {
+			if p >= 1 || rand.Float64() < p {
+				if node == 0 {
+					return nil
+				}
+				return excRes(req, ec)
+			}
+			return h.Handle(node, req)
+		})
+	}
+}
+
+// HandlerStats is a snapshot of the statistics kept by HandlerMetrics.
+type HandlerStats struct {
+	// Requests handled, by function code.
+	Req map[FnCode]uint64
+	// Exception responses, by exception code.
+	Exc map[ExCode]uint64
+	// Requests not responded to (including broadcasts).
+	NoRes uint64
+	// Request handling time statistics.
+	Time LatencyStats
+}
+
+// HandlerMetrics keeps statistics for the requests passed through
+// it. Its Wrap method is a middleware. It is ok to call its methods
+// while it is being used by a slave.
+type HandlerMetrics struct {
+	mu    sync.Mutex
+	req   map[FnCode]uint64
+	exc   map[ExCode]uint64
+	noRes uint64
+	lat   latency
+}
+
+// Wrap wraps handler h, keeping statistics for the requests passed
+// to it.
+func (m *HandlerMetrics) Wrap(h SerHandler) SerHandler {
+	return SerHandlerFunc(func(node uint8, req Req) Res {
+		start := time.Now()
+		res := h.Handle(node, req)
+		d := time.Since(start)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.req == nil {
+			m.req = make(map[FnCode]uint64)
+			m.exc = make(map[ExCode]uint64)
+		}
+		m.req[req.FnCode()]++
+		if res == nil || node == 0 {
+			m.noRes++
+		} else if e, ok := asExc(res); ok {
+			m.exc[e.ExCode]++
+		}
+		m.lat.n++
+		m.lat.hist[latencyBucket(d)]++
+		m.lat.add(d)
+		return res
+	})
+}
+
+// Stats returns a snapshot of the statistics.
+func (m *HandlerMetrics) Stats() HandlerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := HandlerStats{
+		Req:   make(map[FnCode]uint64, len(m.req)),
+		Exc:   make(map[ExCode]uint64, len(m.exc)),
+		NoRes: m.noRes,
+		Time:  m.lat.stats(),
+	}
+	for k, v := range m.req {
+		st.Req[k] = v
+	}
+	for k, v := range m.exc {
+		st.Exc[k] = v
+	}
+	return st
+}
+
+// Reset resets the statistics.
+func (m *HandlerMetrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.req, m.exc, m.noRes = nil, nil, 0
+	m.lat = latency{}
+}
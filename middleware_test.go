@@ -0,0 +1,83 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	dm := NewDataModel(AddrRange{}, AddrRange{}, AddrRange{0, 10}, AddrRange{})
+	var logs []string
+	logf := func(format string, v ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, v...))
+	}
+	var recs []FnCode
+	rec := func(node uint8, req Req, res Res) {
+		recs = append(recs, req.FnCode())
+	}
+	var m HandlerMetrics
+	h := Chain(dm, m.Wrap, Logger(logf), Record(rec),
+		AllowFns(RdHoldingRegs, WrReg))
+	c := NewClient(handlerDoer{h})
+
+	if err := c.WriteSingleRegister(1, 0, 1); err != nil {
+		t.Fatalf("WriteSingleRegister: %s", err)
+	}
+	if _, err := c.ReadHoldingRegisters(1, 0, 1); err != nil {
+		t.Fatalf("ReadHoldingRegisters: %s", err)
+	}
+	if err := c.WriteMultipleRegisters(1, 0, []uint16{1}); !isExc(err, BadFnCode) {
+		t.Fatalf("Expected BadFnCode, got: %v", err)
+	}
+	if len(logs) != 3 || len(recs) != 3 || recs[2] != WrRegs {
+		t.Fatalf("Logs / records: %q, %v", logs, recs)
+	}
+	st := m.Stats()
+	if st.Req[WrReg] != 1 || st.Req[WrRegs] != 1 ||
+		st.Exc[BadFnCode] != 1 || st.Time.N != 3 {
+		t.Fatalf("Stats: %+v", st)
+	}
+	m.Reset()
+	if st := m.Stats(); len(st.Req) != 0 || st.Time.N != 0 {
+		t.Fatalf("Stats after reset: %+v", st)
+	}
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	h := Chain(testHandler{}, RateLimit(100, 2))
+	req := &ReqResWrReg{Addr: 1, Val: 1}
+	busy := 0
+	for i := 0; i < 4; i++ {
+		if e, ok := h.Handle(1, req).(*ResExc); ok && e.ExCode == SrvBusy {
+			busy++
+		}
+	}
+	if busy != 2 {
+		t.Fatalf("Busy responses: %d, expected 2", busy)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := h.Handle(1, req).(*ResExc); ok {
+		t.Fatalf("Rate limited after refill")
+	}
+}
+
+func TestMiddlewareInject(t *testing.T) {
+	h := Chain(testHandler{}, InjectExc(1, SrvFail), Delay(time.Millisecond))
+	req := &ReqResWrReg{Addr: 1, Val: 1}
+	if e, ok := h.Handle(1, req).(*ResExc); !ok || e.ExCode != SrvFail {
+		t.Fatalf("Expected SrvFail exception")
+	}
+	if res := h.Handle(0, req); res != nil {
+		t.Fatalf("Response to broadcast: %v", res)
+	}
+	h = Chain(testHandler{}, InjectExc(0, SrvFail), Delay(time.Millisecond))
+	if res := h.Handle(1, req); res != Res(req) {
+		t.Fatalf("Bad response: %v", res)
+	}
+}
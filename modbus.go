@@ -66,6 +66,21 @@ const (
 	GwRespFail ExCode = 0x0b
 )
 
+// Table identifies one of the four modbus data tables.
+type Table uint8
+
+const (
+	TblCoils       Table = iota // Coils (read-write bits)
+	TblInputs                   // Discrete inputs (read-only bits)
+	TblHoldingRegs              // Holding registers (read-write)
+	TblInputRegs                // Input registers (read-only)
+	TblNum         = iota
+)
+
+// IsBits returns true if the table contains bits (coils or discrete
+// inputs) and false if it contains registers.
+func (t Table) IsBits() bool { return t == TblCoils || t == TblInputs }
+
 /* Dummy types and methods to be embedded in other types and "flag"
    them as modbus requests or responses.  A type that has an
    fmbReqRes() method is either a request or a response.  A type that
@@ -139,7 +154,7 @@ func NewReq(f FnCode) (Req, error) {
 	case WrCoil:
 		return &ReqResWrCoil{}, nil
 	case WrCoils:
-		return nil, errFnUnsup
+		return &ReqWrCoils{}, nil
 	case RdInputRegs:
 		return &ReqRdRegs{Holding: false}, nil
 	case RdHoldingRegs:
@@ -147,17 +162,21 @@ func NewReq(f FnCode) (Req, error) {
 	case WrReg:
 		return &ReqResWrReg{}, nil
 	case WrRegs:
-		return nil, errFnUnsup
+		return &ReqWrRegs{}, nil
 	case MskWrReg:
-		return nil, errFnUnsup
+		return &ReqResMskWrReg{}, nil
 	case RdWrRegs:
-		return nil, errFnUnsup
+		return &ReqRdWrRegs{}, nil
 	case RdFIFO, RdFileRec, WrFileRec:
 		return nil, errFnUnsup
-	case RdExcStatus, Diag, GetComCnt, GetComLog:
-		return nil, errFnUnsup
-	case SlaveId, RdDevId:
+	case Diag:
+		return &ReqResDiag{}, nil
+	case RdExcStatus, GetComCnt, GetComLog:
 		return nil, errFnUnsup
+	case SlaveId:
+		return &ReqSlaveId{}, nil
+	case RdDevId:
+		return &ReqRdDevId{}, nil
 	default:
 		return nil, errFnCode
 	}
@@ -181,7 +200,7 @@ func NewRes(f FnCode) (Res, error) {
 	case WrCoil:
 		return &ReqResWrCoil{}, nil
 	case WrCoils:
-		return nil, errFnUnsup
+		return &ResWrCoils{}, nil
 	case RdInputRegs:
 		return &ResRdRegs{Holding: false}, nil
 	case RdHoldingRegs:
@@ -189,25 +208,70 @@ func NewRes(f FnCode) (Res, error) {
 	case WrReg:
 		return &ReqResWrReg{}, nil
 	case WrRegs:
-		return nil, errFnUnsup
+		return &ResWrRegs{}, nil
 	case MskWrReg:
-		return nil, errFnUnsup
+		return &ReqResMskWrReg{}, nil
 	case RdWrRegs:
-		return nil, errFnUnsup
+		return &ResRdWrRegs{}, nil
 	case RdFIFO, RdFileRec, WrFileRec:
 		return nil, errFnUnsup
-	case RdExcStatus, Diag, GetComCnt, GetComLog:
-		return nil, errFnUnsup
-	case SlaveId, RdDevId:
+	case Diag:
+		return &ReqResDiag{}, nil
+	case RdExcStatus, GetComCnt, GetComLog:
 		return nil, errFnUnsup
+	case SlaveId:
+		return &ResSlaveId{}, nil
+	case RdDevId:
+		return &ResRdDevId{}, nil
 	default:
 		return nil, errFnCode
 	}
 }
 
+// CanBroadcast returns true if requests with function code f can be
+// broadcast (sent to node 0). Only write requests can be broadcast.
+func CanBroadcast(f FnCode) bool {
+	switch f {
+	case WrCoil, WrCoils, WrReg, WrRegs, MskWrReg, WrFileRec:
+		return true
+	default:
+		return false
+	}
+}
+
 // PDU is a byte-slice holding a ModBus PDU
 type PDU []byte
 
 func (p PDU) IsExc() bool    { return p[0]&ExcFlag != 0 }
 func (p PDU) ExCode() ExCode { return ExCode(p[1]) }
 func (p PDU) FnCode() FnCode { return FnCode(p[0] & ^ExcFlag) }
+
+// unpackRes unpacks response PDU p, which is expected to be a response
+// to a request with function code fn, in res. If res is nil, a propper
+// response type is allocated. Returns the unpacked response. If p is
+// an exception response it returns nil and the exception (*ResExc) as
+// an error. If p cannot be unpacked, or does not correspond to fn, it
+// returns nil and ErrResponse.
+func unpackRes(p PDU, fn FnCode, res Res) (Res, error) {
+	if len(p) < 2 || p.FnCode() != fn {
+		return nil, ErrResponse
+	}
+	if p.IsExc() {
+		exc := &ResExc{}
+		if _, err := exc.Unpack(p); err != nil {
+			return nil, ErrResponse
+		}
+		return nil, exc
+	}
+	if res == nil {
+		var err error
+		res, err = NewRes(fn)
+		if err != nil {
+			return nil, ErrResponse
+		}
+	}
+	if _, err := res.Unpack(p); err != nil {
+		return nil, ErrResponse
+	}
+	return res, nil
+}
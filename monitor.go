@@ -0,0 +1,252 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"time"
+)
+
+// Transaction is a request / response transaction, observed on the
+// bus by a Monitor.
+type Transaction struct {
+	Node uint8
+	// Request frame, and decoded request (nil if it cannot be
+	// decoded, e.g. unsupported function code).
+	ReqADU SerADU
+	Req    Req
+	// Response frame, and decoded response (nil if no response
+	// was received, or it cannot be decoded). Exception responses
+	// are decoded as *ResExc.
+	ResADU SerADU
+	Res    Res
+	// Times the reception of the request and the response
+	// started. ResTime is zero if no response was received.
+	ReqTime time.Time
+	ResTime time.Time
+	// Err is nil if a response was received, and it matches the
+	// request (or if the request was a broadcast). Otherwise it
+	// is ErrTimeout (no response), ErrCRC or ErrFrame (bad
+	// response frame), or an *ErrMismatch (the response does not
+	// match the request). If a bad frame was received in place of
+	// a request, Err is ErrCRC or ErrFrame, and ReqADU is nil. If
+	// a response was received with no request before it (possible
+	// only with receivers that tell requests from responses by
+	// themselves, like SerSnifferRTU), Err is ErrResponse, and
+	// ReqADU is nil.
+	Err error
+}
+
+// Monitor passively monitors a modbus-over-serial bus. It receives
+// the requests of the master, and the responses of the slaves, pairs
+// them, and reports them as transactions. It never transmits.
+//
+// With a standard receiver (e.g. SerReceiverRTU) the monitor, like a
+// slave, must be synchronized to the start of a request, and then
+// stays synchronized by receiving requests and responses in turn
+// (see "rtu-timing.txt"). With a sniffer (SerSnifferRTU), which
+// tells requests from responses by itself, the monitor can join a
+// busy bus at any time.
+type Monitor struct {
+	// Response timeout. Counting approx. from the *end* of the
+	// request reception, until the reception of the first
+	// response byte.
+	Timeout time.Duration
+
+	rcv      SerReceiver
+	synced   bool
+	held     SerADU // Request received in place of a response
+	heldTime time.Time
+}
+
+// sniffer is implemented by receivers that tell requests from
+// responses by themselves (SerSnifferRTU).
+type sniffer interface {
+	Receive(b []byte, deadline time.Time) (SerADU, bool, error)
+}
+
+// recv receives a request (if req is true) or a response frame. It
+// returns the frame, and true if it is a request. Sniffers may return
+// a frame other than the one asked for.
+func (m *Monitor) recv(deadline time.Time, req bool) (SerADU, bool, error) {
+	if sn, ok := m.rcv.(sniffer); ok {
+		return sn.Receive(nil, deadline)
+	}
+	var a SerADU
+	var err error
+	if req {
+		a, err = m.rcv.ReceiveReq(nil, deadline)
+	} else {
+		a, err = m.rcv.ReceiveRes(nil, deadline)
+	}
+	return a, req, err
+}
+
+// NewMonitor returns a bus monitor that uses the given serial
+// receiver.
+func NewMonitor(rcv SerReceiver) *Monitor {
+	return &Monitor{rcv: rcv, Timeout: DflSerSlvTimeout}
+}
+
+// firstByte returns the time the first byte of the last frame was
+// received by rcv, if rcv can tell, or dfl if it cannot.
+func firstByte(rcv SerReceiver, dfl time.Time) time.Time {
+	if fb, ok := rcv.(interface {
+		FirstByte() time.Time
+	}); ok && !fb.FirstByte().IsZero() {
+		return fb.FirstByte()
+	}
+	return dfl
+}
+
+// decodeReq returns the request in frame a, or nil if it cannot be
+// decoded.
+func decodeReq(a SerADU) Req {
+	req, err := NewReq(a.FnCode())
+	if err != nil {
+		return nil
+	}
+	if _, err := req.Unpack(a.PDU()); err != nil {
+		return nil
+	}
+	return req
+}
+
+// decodeRes returns the response in frame a, or nil if it cannot be
+// decoded.
+func decodeRes(a SerADU) Res {
+	p := a.PDU()
+	var res Res = &ResExc{}
+	if !p.IsExc() {
+		var err error
+		if res, err = NewRes(p.FnCode()); err != nil {
+			return nil
+		}
+	}
+	if _, err := res.Unpack(p); err != nil {
+		return nil
+	}
+	return res
+}
+
+// response receives the response for transaction t, and completes
+// it. It returns an error only if it is an I/O error.
+func (m *Monitor) response(t *Transaction) error {
+	start := time.Now()
+	a, req, err := m.recv(start.Add(m.Timeout), false)
+	if err != nil {
+		if _, ok := err.(*ErrIO); ok {
+			return err
+		}
+		if err == ErrFrame || err == ErrCRC {
+			m.synced = false
+		}
+		t.Err = err
+		return nil
+	}
+	if req {
+		// No response, next request started
+		t.Err = ErrTimeout
+		m.held, m.heldTime = a, firstByte(m.rcv, start)
+		return nil
+	}
+	t.ResADU, t.ResTime = a, firstByte(m.rcv, start)
+	t.Res = decodeRes(a)
+	fn := t.ReqADU.FnCode()
+	switch {
+	case a.Node() != t.Node:
+		m.synced = false
+		t.Err = mismatch(fn, "reply from node %d", a.Node())
+	case a.FnCode() != fn:
+		t.Err = mismatch(fn, "function code %s", a.FnCode())
+	case t.Req != nil && t.Res != nil:
+		t.Err = validateRes(t.Req, t.Res)
+	}
+	return nil
+}
+
+// Run runs the monitor, sending the transactions observed to channel
+// c, until ctx is done, in which case it returns nil, or until an
+// I/O error occurs, in which case it returns the error (wrapped in
+// ErrIO). Run closes c before returning. Cancellation takes effect
+// after the transaction in progress (if any) completes; while the bus
+// is idle it takes effect within approx. one second.
+func (m *Monitor) Run(ctx context.Context, c chan<- Transaction) error {
+	const reqTmo = 1 * time.Second
+	defer close(c)
+	emit := func(t Transaction) bool {
+		select {
+		case c <- t:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !m.synced {
+			if err := m.rcv.SyncContext(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			m.synced = true
+		}
+		var a SerADU
+		var req bool
+		var err error
+		start := time.Now()
+		if m.held != nil {
+			a, req, start = m.held, true, m.heldTime
+			m.held = nil
+		} else {
+			deadline := start.Add(reqTmo)
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			a, req, err = m.recv(deadline, true)
+			if err == nil {
+				start = firstByte(m.rcv, start)
+			}
+		}
+		if err != nil {
+			if _, ok := err.(*ErrIO); ok {
+				return err
+			}
+			if err == ErrFrame || err == ErrCRC {
+				m.synced = false
+				t := Transaction{ReqTime: start, Err: err}
+				if !emit(t) {
+					return nil
+				}
+			}
+			// Timeout, next request
+			continue
+		}
+		if !req {
+			// Response without request
+			t := Transaction{Node: a.Node(), ResADU: a, ResTime: start,
+				Res: decodeRes(a), Err: ErrResponse}
+			if !emit(t) {
+				return nil
+			}
+			continue
+		}
+		t := Transaction{Node: a.Node(), ReqADU: a, ReqTime: start,
+			Req: decodeReq(a)}
+		if t.Node != 0 {
+			if err := m.response(&t); err != nil {
+				return err
+			}
+		}
+		if !emit(t) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	p := &testSerPort{}
+	rcv := NewSerReceiverRTU(p)
+	rcv.SyncDelay = 2 * time.Millisecond
+	rcv.FrameTimeout = 10 * time.Millisecond
+	m := NewMonitor(rcv)
+	m.Timeout = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan Transaction)
+	done := make(chan error)
+	go func() { done <- m.Run(ctx, c) }()
+	if !p.WaitTimeout(0) {
+		t.Fatalf("Monitor did not sync")
+	}
+
+	next := func(frames ...[]byte) Transaction {
+		for _, f := range frames {
+			p.Inject(f)
+		}
+		select {
+		case tr := <-c:
+			return tr
+		case <-time.After(time.Second):
+			t.Fatalf("No transaction")
+		}
+		return Transaction{}
+	}
+	rdReq := &ReqRdRegs{Holding: true, Addr: 10, Num: 2}
+	rdRes := &ResRdRegs{Holding: true, Val: []uint16{1, 2}}
+
+	// Normal transaction
+	tr := next(testPack(t, 1, rdReq), testPack(t, 1, rdRes))
+	if tr.Err != nil || tr.Node != 1 || tr.Req == nil || tr.Res == nil ||
+		tr.ResTime.Before(tr.ReqTime) {
+		t.Fatalf("Bad transaction: %+v", tr)
+	}
+	if r := tr.Res.(*ResRdRegs); len(r.Val) != 2 || r.Val[1] != 2 {
+		t.Fatalf("Bad response: %+v", r)
+	}
+	// Exception
+	tr = next(testPack(t, 2, rdReq),
+		testPack(t, 2, &ResExc{Function: RdHoldingRegs, ExCode: BadAddress}))
+	if e, ok := tr.Res.(*ResExc); tr.Err != nil || !ok || e.ExCode != BadAddress {
+		t.Fatalf("Bad exception transaction: %+v", tr)
+	}
+	// Timeout
+	tr = next(testPack(t, 3, rdReq))
+	if tr.Err != ErrTimeout || tr.ResADU != nil {
+		t.Fatalf("Bad timed-out transaction: %+v", tr)
+	}
+	// Broadcast
+	tr = next(testPack(t, 0, &ReqResWrReg{Addr: 1, Val: 1}))
+	if tr.Err != nil || tr.Node != 0 || tr.Req == nil {
+		t.Fatalf("Bad broadcast transaction: %+v", tr)
+	}
+	// Mismatched response
+	tr = next(testPack(t, 1, rdReq),
+		testPack(t, 1, &ResRdRegs{Holding: true, Val: []uint16{1}}))
+	if !IsBadResponse(tr.Err) {
+		t.Fatalf("Bad mismatched transaction: %+v", tr)
+	}
+	// Bad CRC in response
+	res := testPack(t, 1, rdRes)
+	res[len(res)-1] ^= 0xff
+	tr = next(testPack(t, 1, rdReq), res)
+	if tr.Err != ErrCRC || tr.Req == nil {
+		t.Fatalf("Bad CRC-error transaction: %+v", tr)
+	}
+	// Wait for the monitor to re-sync
+	if !p.WaitTimeout(p.Timeouts()) {
+		t.Fatalf("Monitor did not re-sync")
+	}
+	tr = next(testPack(t, 1, rdReq), testPack(t, 1, rdRes))
+	if tr.Err != nil {
+		t.Fatalf("Bad transaction after resync: %+v", tr)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+	if _, ok := <-c; ok {
+		t.Fatalf("Channel not closed")
+	}
+}
@@ -149,7 +149,7 @@ func (r *ResRdInputs) Unpack(b []byte) ([]byte, error) {
 		return b, errUnpack
 	}
 	n := b[1]
-	if n < 1 || n > 250 {
+	if n < 1 || n > 250 || len(b) < 2+int(n) {
 		return b, errUnpack
 	}
 	r.BitStat = r.BitStat[0:0]
@@ -282,7 +282,7 @@ func (r *ReqResWrReg) Pack(b []byte) ([]byte, error) {
 }
 
 func (r *ReqResWrReg) Unpack(b []byte) ([]byte, error) {
-	if b[0] != byte(WrReg) {
+	if len(b) < 5 || b[0] != byte(WrReg) {
 		return b, errUnpack
 	}
 	b = uU16s(b[1:], &r.Addr, &r.Val)
@@ -310,7 +310,7 @@ func (r *ReqResWrCoil) Pack(b []byte) ([]byte, error) {
 }
 
 func (r *ReqResWrCoil) Unpack(b []byte) ([]byte, error) {
-	if b[0] != byte(WrCoil) {
+	if len(b) < 5 || b[0] != byte(WrCoil) {
 		return b, errUnpack
 	}
 	var val uint16
@@ -326,8 +326,35 @@ func (r *ReqResWrCoil) Unpack(b []byte) ([]byte, error) {
 	return b1, nil
 }
 
-// ReqWrCoils is the write-multiple-coils request. See
-// [1],§6.11,pg.29
+// ReqResMskWrReg is the mask-write-register request and response. The
+// register is modified like this: (Val AND AndMsk) OR (OrMsk AND (NOT
+// AndMsk)). See [1],§6.16,pg.36
+type ReqResMskWrReg struct {
+	mbReqRes
+	Addr   uint16
+	AndMsk uint16
+	OrMsk  uint16
+}
+
+func (r *ReqResMskWrReg) FnCode() FnCode { return MskWrReg }
+
+func (r *ReqResMskWrReg) Pack(b []byte) ([]byte, error) {
+	b = append(b, byte(MskWrReg))
+	b = pU16s(b, r.Addr, r.AndMsk, r.OrMsk)
+	return b, nil
+}
+
+func (r *ReqResMskWrReg) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 7 || b[0] != byte(MskWrReg) {
+		return b, errUnpack
+	}
+	b = uU16s(b[1:], &r.Addr, &r.AndMsk, &r.OrMsk)
+	return b, nil
+}
+
+// ReqWrCoils is the write-multiple-coils request. Num is the number of
+// coils to write. BitStat holds the coil values, packed as in
+// ResRdInputs. See [1],§6.11,pg.29
 type ReqWrCoils struct {
 	mbReq
 	Addr    uint16
@@ -337,13 +364,37 @@ type ReqWrCoils struct {
 
 func (r *ReqWrCoils) FnCode() FnCode { return WrCoils }
 
+// Status returns the status of coil n (zero-based)
+func (r ReqWrCoils) Status(n int) bool {
+	return r.BitStat[n>>3]&(1<<(uint(n)&7)) != 0
+}
+
 func (r *ReqWrCoils) Pack(b []byte) ([]byte, error) {
-	//n := len(r.BitStat)
+	n := (int(r.Num) + 7) / 8
+	if r.Num < 1 || r.Num > 0x7b0 || len(r.BitStat) != n {
+		return b, errPack
+	}
+	b = append(b, byte(WrCoils))
+	b = pU16s(b, r.Addr, r.Num)
+	b = append(b, byte(n))
+	b = append(b, r.BitStat...)
 	return b, nil
 }
 
 func (r *ReqWrCoils) Unpack(b []byte) ([]byte, error) {
-	return b, nil
+	if len(b) < 7 || b[0] != byte(WrCoils) {
+		return b, errUnpack
+	}
+	var addr, num uint16
+	b1 := uU16s(b[1:], &addr, &num)
+	n := int(b1[0])
+	if num < 1 || num > 0x7b0 || n != (int(num)+7)/8 || len(b1) < n+1 {
+		return b, errUnpack
+	}
+	r.Addr, r.Num = addr, num
+	r.BitStat = r.BitStat[0:0]
+	r.BitStat = append(r.BitStat, b1[1:1+n]...)
+	return b1[1+n:], nil
 }
 
 // ResWrCoils is the write-multiple-coils response. See
@@ -357,10 +408,16 @@ type ResWrCoils struct {
 func (r *ResWrCoils) FnCode() FnCode { return WrCoils }
 
 func (r *ResWrCoils) Pack(b []byte) ([]byte, error) {
+	b = append(b, byte(WrCoils))
+	b = pU16s(b, r.Addr, r.Num)
 	return b, nil
 }
 
 func (r *ResWrCoils) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 5 || b[0] != byte(WrCoils) {
+		return b, errUnpack
+	}
+	b = uU16s(b[1:], &r.Addr, &r.Num)
 	return b, nil
 }
 
@@ -369,17 +426,42 @@ func (r *ResWrCoils) Unpack(b []byte) ([]byte, error) {
 type ReqWrRegs struct {
 	mbReq
 	Addr uint16
-	Val  []byte
+	Val  []uint16
 }
 
 func (r *ReqWrRegs) FnCode() FnCode { return WrRegs }
 
 func (r *ReqWrRegs) Pack(b []byte) ([]byte, error) {
+	n := len(r.Val)
+	if n < 1 || n > 123 {
+		return b, errPack
+	}
+	b = append(b, byte(WrRegs))
+	b = pU16s(b, r.Addr, uint16(n))
+	b = append(b, byte(n*2))
+	b = pU16s(b, r.Val...)
 	return b, nil
 }
 
 func (r *ReqWrRegs) Unpack(b []byte) ([]byte, error) {
-	return b, nil
+	if len(b) < 6 || b[0] != byte(WrRegs) {
+		return b, errUnpack
+	}
+	var addr, num uint16
+	b1 := uU16s(b[1:], &addr, &num)
+	n := int(b1[0])
+	if num < 1 || num > 123 || n != int(num)*2 || len(b1) < n+1 {
+		return b, errUnpack
+	}
+	r.Addr = addr
+	r.Val = r.Val[0:0]
+	b1 = b1[1:]
+	for i := 0; i < int(num); i++ {
+		var reg uint16
+		b1 = uU16s(b1, &reg)
+		r.Val = append(r.Val, reg)
+	}
+	return b1, nil
 }
 
 // ResWrRegs is the write-multiple-registers response. See
@@ -393,9 +475,308 @@ type ResWrRegs struct {
 func (r *ResWrRegs) FnCode() FnCode { return WrRegs }
 
 func (r *ResWrRegs) Pack(b []byte) ([]byte, error) {
+	b = append(b, byte(WrRegs))
+	b = pU16s(b, r.Addr, r.Num)
 	return b, nil
 }
 
 func (r *ResWrRegs) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 5 || b[0] != byte(WrRegs) {
+		return b, errUnpack
+	}
+	b = uU16s(b[1:], &r.Addr, &r.Num)
 	return b, nil
 }
+
+// ReqRdWrRegs is the read-write-multiple-registers request. The write
+// operation is performed before the read. See [1],§6.17,pg.38
+type ReqRdWrRegs struct {
+	mbReq
+	RdAddr uint16
+	RdNum  uint16
+	WrAddr uint16
+	WrVal  []uint16
+}
+
+func (r *ReqRdWrRegs) FnCode() FnCode { return RdWrRegs }
+
+func (r *ReqRdWrRegs) Pack(b []byte) ([]byte, error) {
+	n := len(r.WrVal)
+	if r.RdNum < 1 || r.RdNum > 125 || n < 1 || n > 121 {
+		return b, errPack
+	}
+	b = append(b, byte(RdWrRegs))
+	b = pU16s(b, r.RdAddr, r.RdNum, r.WrAddr, uint16(n))
+	b = append(b, byte(n*2))
+	b = pU16s(b, r.WrVal...)
+	return b, nil
+}
+
+func (r *ReqRdWrRegs) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 10 || b[0] != byte(RdWrRegs) {
+		return b, errUnpack
+	}
+	var rdAddr, rdNum, wrAddr, wrNum uint16
+	b1 := uU16s(b[1:], &rdAddr, &rdNum, &wrAddr, &wrNum)
+	n := int(b1[0])
+	if rdNum < 1 || rdNum > 125 || wrNum < 1 || wrNum > 121 ||
+		n != int(wrNum)*2 || len(b1) < n+1 {
+		return b, errUnpack
+	}
+	r.RdAddr, r.RdNum, r.WrAddr = rdAddr, rdNum, wrAddr
+	r.WrVal = r.WrVal[0:0]
+	b1 = b1[1:]
+	for i := 0; i < int(wrNum); i++ {
+		var reg uint16
+		b1 = uU16s(b1, &reg)
+		r.WrVal = append(r.WrVal, reg)
+	}
+	return b1, nil
+}
+
+// ResRdWrRegs is the read-write-multiple-registers response. See
+// [1],§6.17,pg.38
+type ResRdWrRegs struct {
+	mbRes
+	Val []uint16
+}
+
+func (r *ResRdWrRegs) FnCode() FnCode { return RdWrRegs }
+
+func (r *ResRdWrRegs) Pack(b []byte) ([]byte, error) {
+	n := len(r.Val)
+	if n < 1 || n > 125 {
+		return b, errPack
+	}
+	b = append(b, byte(RdWrRegs), byte(n*2))
+	b = pU16s(b, r.Val...)
+	return b, nil
+}
+
+func (r *ResRdWrRegs) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != byte(RdWrRegs) {
+		return b, errUnpack
+	}
+	n := int(b[1])
+	if n < 2 || n > 250 || n&1 != 0 {
+		return b, errUnpack
+	}
+	b1 := b[2:]
+	if len(b1) < n {
+		return b, errUnpack
+	}
+	r.Val = r.Val[0:0]
+	for i := 0; i < n; i += 2 {
+		var reg uint16
+		b1 = uU16s(b1, &reg)
+		r.Val = append(r.Val, reg)
+	}
+	return b1, nil
+}
+
+// Diagnostics sub-function codes. See [1],§6.8,pg.21
+const (
+	DiagQueryData    uint16 = 0x00 // Return query data
+	DiagRestartComm  uint16 = 0x01 // Restart communications option
+	DiagRdDiagReg    uint16 = 0x02 // Return diagnostic register
+	DiagAsciiDelim   uint16 = 0x03 // Change ASCII input delimiter
+	DiagListenOnly   uint16 = 0x04 // Force listen only mode
+	DiagClearCnt     uint16 = 0x0a // Clear counters and diag. register
+	DiagBusMsgCnt    uint16 = 0x0b // Return bus message count
+	DiagBusErrCnt    uint16 = 0x0c // Return bus comm. error count
+	DiagBusExcCnt    uint16 = 0x0d // Return bus exception error count
+	DiagSlvMsgCnt    uint16 = 0x0e // Return server message count
+	DiagSlvNoResCnt  uint16 = 0x0f // Return server no response count
+	DiagSlvNAKCnt    uint16 = 0x10 // Return server NAK count
+	DiagSlvBusyCnt   uint16 = 0x11 // Return server busy count
+	DiagOverrunCnt   uint16 = 0x12 // Return bus char. overrun count
+	DiagClearOverrun uint16 = 0x14 // Clear overrun counter and flag
+)
+
+// ReqResDiag is the diagnostics (serial line only) request and
+// response. Sub is the sub-function code (DiagXXX constants), and
+// Data the data field. For most sub-functions, the response echoes
+// the request; for the DiagXXXCnt sub-functions it returns the
+// counter value in Data. See [1],§6.8,pg.20
+type ReqResDiag struct {
+	mbReqRes
+	Sub  uint16
+	Data []uint16
+}
+
+func (r *ReqResDiag) FnCode() FnCode { return Diag }
+
+func (r *ReqResDiag) Pack(b []byte) ([]byte, error) {
+	if 3+2*len(r.Data) > MaxPDU {
+		return b, errPack
+	}
+	b = append(b, byte(Diag))
+	b = pU16s(b, r.Sub)
+	b = pU16s(b, r.Data...)
+	return b, nil
+}
+
+func (r *ReqResDiag) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 3 || b[0] != byte(Diag) || (len(b)-3)%2 != 0 {
+		return b, errUnpack
+	}
+	b = uU16s(b[1:], &r.Sub)
+	r.Data = r.Data[0:0]
+	for len(b) > 0 {
+		var w uint16
+		b = uU16s(b, &w)
+		r.Data = append(r.Data, w)
+	}
+	return b, nil
+}
+
+// ReqSlaveId is the report-server-id request. See [1],§6.13,pg.31
+type ReqSlaveId struct {
+	mbReq
+}
+
+func (r *ReqSlaveId) FnCode() FnCode { return SlaveId }
+
+func (r *ReqSlaveId) Pack(b []byte) ([]byte, error) {
+	b = append(b, byte(SlaveId))
+	return b, nil
+}
+
+func (r *ReqSlaveId) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 1 || b[0] != byte(SlaveId) {
+		return b, errUnpack
+	}
+	return b[1:], nil
+}
+
+// ResSlaveId is the report-server-id response. Data holds the
+// device-specific server id, the run-indicator status byte, and any
+// additional data, as reported by the server. See [1],§6.13,pg.31
+type ResSlaveId struct {
+	mbRes
+	Data []byte
+}
+
+func (r *ResSlaveId) FnCode() FnCode { return SlaveId }
+
+func (r *ResSlaveId) Pack(b []byte) ([]byte, error) {
+	n := len(r.Data)
+	if n < 1 || n > MaxPDU-2 {
+		return b, errPack
+	}
+	b = append(b, byte(SlaveId), byte(n))
+	b = append(b, r.Data...)
+	return b, nil
+}
+
+func (r *ResSlaveId) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != byte(SlaveId) {
+		return b, errUnpack
+	}
+	n := int(b[1])
+	if n < 1 || len(b) < n+2 {
+		return b, errUnpack
+	}
+	r.Data = append(r.Data[0:0], b[2:n+2]...)
+	return b[n+2:], nil
+}
+
+// MEI type for read-device-identification requests
+const meiDevId = 0x0e
+
+// Read-device-identification codes
+const (
+	DevIdBasic      uint8 = 0x01 // Stream access, basic objects
+	DevIdRegular    uint8 = 0x02 // Stream access, regular objects
+	DevIdExtended   uint8 = 0x03 // Stream access, extended objects
+	DevIdIndividual uint8 = 0x04 // Access to an individual object
+)
+
+// ReqRdDevId is the read-device-identification request. Code is the
+// read-device-id code (DevIdBasic, etc), and ObjId the id of the
+// first object to read. See [1],§6.21,pg.43
+type ReqRdDevId struct {
+	mbReq
+	Code  uint8
+	ObjId uint8
+}
+
+func (r *ReqRdDevId) FnCode() FnCode { return RdDevId }
+
+func (r *ReqRdDevId) Pack(b []byte) ([]byte, error) {
+	if r.Code < DevIdBasic || r.Code > DevIdIndividual {
+		return b, errPack
+	}
+	b = append(b, byte(RdDevId), meiDevId, r.Code, r.ObjId)
+	return b, nil
+}
+
+func (r *ReqRdDevId) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[0] != byte(RdDevId) || b[1] != meiDevId {
+		return b, errUnpack
+	}
+	r.Code, r.ObjId = b[2], b[3]
+	return b[4:], nil
+}
+
+// DevIdObj is a device identification object.
+type DevIdObj struct {
+	Id  uint8
+	Val []byte
+}
+
+// ResRdDevId is the read-device-identification response. If More is
+// true, more objects are available, starting with NextObj. See
+// [1],§6.21,pg.43
+type ResRdDevId struct {
+	mbRes
+	Code       uint8
+	Conformity uint8
+	More       bool
+	NextObj    uint8
+	Objs       []DevIdObj
+}
+
+func (r *ResRdDevId) FnCode() FnCode { return RdDevId }
+
+func (r *ResRdDevId) Pack(b []byte) ([]byte, error) {
+	b0 := b
+	var more uint8
+	if r.More {
+		more = 0xff
+	}
+	b = append(b, byte(RdDevId), meiDevId, r.Code, r.Conformity,
+		more, r.NextObj, byte(len(r.Objs)))
+	for _, o := range r.Objs {
+		if len(o.Val) > 0xff {
+			return b0, errPack
+		}
+		b = append(b, o.Id, byte(len(o.Val)))
+		b = append(b, o.Val...)
+	}
+	if len(b)-len(b0) > MaxPDU {
+		return b0, errPack
+	}
+	return b, nil
+}
+
+func (r *ResRdDevId) Unpack(b []byte) ([]byte, error) {
+	if len(b) < 7 || b[0] != byte(RdDevId) || b[1] != meiDevId {
+		return b, errUnpack
+	}
+	b1 := b[7:]
+	objs := r.Objs[0:0]
+	for i := 0; i < int(b[6]); i++ {
+		if len(b1) < 2 || len(b1) < int(b1[1])+2 {
+			return b, errUnpack
+		}
+		n := int(b1[1])
+		objs = append(objs,
+			DevIdObj{Id: b1[0], Val: append([]byte(nil), b1[2:n+2]...)})
+		b1 = b1[n+2:]
+	}
+	r.Code, r.Conformity = b[2], b[3]
+	r.More, r.NextObj = b[4] == 0xff, b[5]
+	r.Objs = objs
+	return b1, nil
+}
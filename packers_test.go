@@ -125,6 +125,126 @@ var packTestData = []struct {
 			Addr: 0x00ac,
 			Val:  0xdead},
 	},
+	// write-multiple-coils request
+	{
+		true,
+		[]byte{0x0f, 0x00, 0x13, 0x00, 0x0a, 0x02, 0xcd, 0x01},
+		&ReqWrCoils{
+			Addr:    0x0013,
+			Num:     0x000a,
+			BitStat: []byte{0xcd, 0x01}},
+	},
+	// write-multiple-coils response
+	{
+		false,
+		[]byte{0x0f, 0x00, 0x13, 0x00, 0x0a},
+		&ResWrCoils{
+			Addr: 0x0013,
+			Num:  0x000a},
+	},
+	// write-multiple-regs request
+	{
+		true,
+		[]byte{0x10, 0x00, 0x01, 0x00, 0x02, 0x04, 0x00, 0x0a, 0x01, 0x02},
+		&ReqWrRegs{
+			Addr: 0x0001,
+			Val:  []uint16{0x000a, 0x0102}},
+	},
+	// write-multiple-regs response
+	{
+		false,
+		[]byte{0x10, 0x00, 0x01, 0x00, 0x02},
+		&ResWrRegs{
+			Addr: 0x0001,
+			Num:  0x0002},
+	},
+	// mask-write-reg request
+	{
+		true,
+		[]byte{0x16, 0x00, 0x04, 0x00, 0xf2, 0x00, 0x25},
+		&ReqResMskWrReg{
+			Addr:   0x0004,
+			AndMsk: 0x00f2,
+			OrMsk:  0x0025},
+	},
+	// mask-write-reg response
+	{
+		false,
+		[]byte{0x16, 0x00, 0x04, 0x00, 0xf2, 0x00, 0x25},
+		&ReqResMskWrReg{
+			Addr:   0x0004,
+			AndMsk: 0x00f2,
+			OrMsk:  0x0025},
+	},
+	// read-write-multiple-regs request
+	{
+		true,
+		[]byte{0x17, 0x00, 0x03, 0x00, 0x06, 0x00, 0x0e, 0x00, 0x03,
+			0x06, 0x00, 0xff, 0x00, 0xff, 0x00, 0xff},
+		&ReqRdWrRegs{
+			RdAddr: 0x0003,
+			RdNum:  0x0006,
+			WrAddr: 0x000e,
+			WrVal:  []uint16{0x00ff, 0x00ff, 0x00ff}},
+	},
+	// read-write-multiple-regs response
+	{
+		false,
+		[]byte{0x17, 0x0c, 0x00, 0xfe, 0x0a, 0xcd, 0x00, 0x01,
+			0x00, 0x03, 0x00, 0x0d, 0x00, 0xff},
+		&ResRdWrRegs{
+			Val: []uint16{0x00fe, 0x0acd, 0x0001,
+				0x0003, 0x000d, 0x00ff}},
+	},
+	// diagnostics request / response
+	{
+		true,
+		[]byte{0x08, 0x00, 0x0b, 0x00, 0x00},
+		&ReqResDiag{
+			Sub:  DiagBusMsgCnt,
+			Data: []uint16{0x0000}},
+	},
+	{
+		false,
+		[]byte{0x08, 0x00, 0x0b, 0x01, 0x2c},
+		&ReqResDiag{
+			Sub:  DiagBusMsgCnt,
+			Data: []uint16{300}},
+	},
+	// report-server-id request
+	{
+		true,
+		[]byte{0x11},
+		&ReqSlaveId{},
+	},
+	// report-server-id response
+	{
+		false,
+		[]byte{0x11, 0x03, 0x42, 0xff, 0x01},
+		&ResSlaveId{
+			Data: []byte{0x42, 0xff, 0x01}},
+	},
+	// read-device-id request
+	{
+		true,
+		[]byte{0x2b, 0x0e, 0x01, 0x00},
+		&ReqRdDevId{
+			Code:  DevIdBasic,
+			ObjId: 0x00},
+	},
+	// read-device-id response
+	{
+		false,
+		[]byte{0x2b, 0x0e, 0x01, 0x01, 0x00, 0x00, 0x02,
+			0x00, 0x03, 'A', 'C', 'M',
+			0x01, 0x02, 'X', '1'},
+		&ResRdDevId{
+			Code:       DevIdBasic,
+			Conformity: 0x01,
+			Objs: []DevIdObj{
+				{Id: 0x00, Val: []byte("ACM")},
+				{Id: 0x01, Val: []byte("X1")}}},
+	},
 }
 
 func TestPackers(t *testing.T) {
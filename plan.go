@@ -0,0 +1,198 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import "sort"
+
+// Tag is a range of Len registers or bits, starting at address Addr,
+// in a data table.
+type Tag struct {
+	Table Table
+	Addr  uint16
+	Len   uint16
+}
+
+// end returns the address after the last register or bit of the tag
+func (t Tag) end() int { return int(t.Addr) + int(t.Len) }
+
+// overlaps returns true if tags t and t1 (assumed to be in the same
+// table) have at least one register or bit in common.
+func (t Tag) overlaps(t1 Tag) bool {
+	return int(t.Addr) < t1.end() && int(t1.Addr) < t.end()
+}
+
+// Planner prepares plans for reading sets of tags with a minimal
+// number of read requests. Neighboring tags are coalesced in the same
+// request if the gap between them is not larger than MaxGap, the
+// request does not exceed the limits (Limits.RdRegs and
+// Limits.RdBits), and the request does not cover any of the Holes.
+type Planner struct {
+	// Maximum number of unused registers or bits between tags
+	// read by the same request.
+	MaxGap int
+	// Limits of the target device. Only RdRegs and RdBits are
+	// used. See type Limits.
+	Limits Limits
+	// Ranges that must not be read (e.g. addresses the device
+	// replies to with exceptions).
+	Holes []Tag
+}
+
+// planLoc is the location of a tag in the plan's responses.
+type planLoc struct {
+	req int
+	off int
+}
+
+// Plan is a set of read requests (ReqRdRegs and ReqRdInputs) that
+// cover a set of tags. Plans are prepared by Planner.Plan.
+type Plan struct {
+	Tags []Tag
+	Reqs []Req
+	loc  []planLoc
+}
+
+// hole returns true if the range r covers any of the planner's holes.
+func (p *Planner) hole(r Tag) bool {
+	for _, h := range p.Holes {
+		if h.Table == r.Table && h.Len > 0 && h.overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan prepares a plan for reading the given tags. It returns
+// ErrRequest if any of the tags has zero length, exceeds the
+// limits, extends beyond the 16-bit address space, or covers a
+// hole.
+func (p *Planner) Plan(tags []Tag) (*Plan, error) {
+	lim := p.Limits.fix()
+	pl := &Plan{Tags: tags, loc: make([]planLoc, len(tags))}
+
+	for _, t := range tags {
+		max := lim.RdRegs
+		if t.Table.IsBits() {
+			max = lim.RdBits
+		}
+		if t.Table >= TblNum || t.Len == 0 || int(t.Len) > max ||
+			t.end() > 0x10000 || p.hole(t) {
+			return nil, ErrRequest
+		}
+	}
+
+	// Tag indexes, sorted by table and address
+	idx := make([]int, len(tags))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		ti, tj := tags[idx[i]], tags[idx[j]]
+		if ti.Table != tj.Table {
+			return ti.Table < tj.Table
+		}
+		return ti.Addr < tj.Addr
+	})
+
+	var cur Tag // Range covered by the current request
+	var grp []int
+	flush := func() {
+		if len(grp) == 0 {
+			return
+		}
+		var req Req
+		switch cur.Table {
+		case TblCoils, TblInputs:
+			req = &ReqRdInputs{Coils: cur.Table == TblCoils,
+				Addr: cur.Addr, Num: cur.Len}
+		default:
+			req = &ReqRdRegs{Holding: cur.Table == TblHoldingRegs,
+				Addr: cur.Addr, Num: cur.Len}
+		}
+		for _, i := range grp {
+			pl.loc[i] = planLoc{len(pl.Reqs), int(tags[i].Addr - cur.Addr)}
+		}
+		pl.Reqs = append(pl.Reqs, req)
+		grp = grp[:0]
+	}
+	for _, i := range idx {
+		t := tags[i]
+		if len(grp) > 0 && t.Table == cur.Table {
+			m := cur
+			if t.end() > m.end() {
+				m.Len = uint16(t.end() - int(m.Addr))
+			}
+			max := lim.RdRegs
+			if t.Table.IsBits() {
+				max = lim.RdBits
+			}
+			if int(t.Addr)-cur.end() <= p.MaxGap &&
+				int(m.Len) <= max && !p.hole(m) {
+				cur = m
+				grp = append(grp, i)
+				continue
+			}
+		}
+		flush()
+		cur = t
+		grp = append(grp, i)
+	}
+	flush()
+	return pl, nil
+}
+
+// Exec issues the plan's requests to the given node, in order, using
+// Doer d. It returns the responses, and the errors. ress[i] and
+// errs[i] are the response and the error for request pl.Reqs[i]; if
+// request i failed, ress[i] is nil.
+func (pl *Plan) Exec(d Doer, node uint8) (ress []Res, errs []error) {
+	ress = make([]Res, len(pl.Reqs))
+	errs = make([]error, len(pl.Reqs))
+	for i, req := range pl.Reqs {
+		ress[i], errs[i] = d.Do(node, req, nil)
+	}
+	return ress, errs
+}
+
+// Req returns the index (in pl.Reqs) of the request that reads tag i
+// (pl.Tags[i]).
+func (pl *Plan) Req(i int) int { return pl.loc[i].req }
+
+// Regs returns the register values for tag i (pl.Tags[i]) from the
+// responses ress (ress[j] must be the response to request
+// pl.Reqs[j]). If the respective response is missing or is invalid
+// it returns nil and ErrResponse.
+func (pl *Plan) Regs(ress []Res, i int) ([]uint16, error) {
+	l, t := pl.loc[i], pl.Tags[i]
+	if l.req >= len(ress) {
+		return nil, ErrResponse
+	}
+	r, ok := ress[l.req].(*ResRdRegs)
+	if !ok || len(r.Val) < l.off+int(t.Len) {
+		return nil, ErrResponse
+	}
+	return r.Val[l.off : l.off+int(t.Len)], nil
+}
+
+// Bits returns the bit values for tag i (pl.Tags[i]) from the
+// responses ress (ress[j] must be the response to request
+// pl.Reqs[j]). If the respective response is missing or is invalid
+// it returns nil and ErrResponse.
+func (pl *Plan) Bits(ress []Res, i int) ([]bool, error) {
+	l, t := pl.loc[i], pl.Tags[i]
+	if l.req >= len(ress) {
+		return nil, ErrResponse
+	}
+	r, ok := ress[l.req].(*ResRdInputs)
+	if !ok || len(r.BitStat)*8 < l.off+int(t.Len) {
+		return nil, ErrResponse
+	}
+	v := make([]bool, t.Len)
+	for k := range v {
+		v[k] = r.Status(l.off + k)
+	}
+	return v, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanner(t *testing.T) {
+	p := &Planner{
+		MaxGap: 10,
+		Limits: Limits{RdRegs: 50},
+		Holes:  []Tag{{TblHoldingRegs, 200, 5}},
+	}
+	tags := []Tag{
+		{TblHoldingRegs, 100, 2}, // 0: req 0
+		{TblHoldingRegs, 195, 2}, // 1: req 1 (hole after)
+		{TblCoils, 3, 1},         // 2: req 2
+		{TblHoldingRegs, 110, 4}, // 3: req 0 (gap 8)
+		{TblHoldingRegs, 205, 1}, // 4: req 3 (hole before)
+		{TblHoldingRegs, 140, 2}, // 5: req 4 (len > 50)
+		{TblHoldingRegs, 101, 2}, // 6: req 0 (overlap)
+		{TblCoils, 10, 3},        // 7: req 2
+		{TblInputRegs, 110, 4},   // 8: req 5 (other table)
+	}
+	pl, err := p.Plan(tags)
+	if err != nil {
+		t.Fatalf("Plan: %s", err)
+	}
+	expReqs := []Req{
+		&ReqRdInputs{Coils: true, Addr: 3, Num: 10},
+		&ReqRdRegs{Holding: true, Addr: 100, Num: 14},
+		&ReqRdRegs{Holding: true, Addr: 140, Num: 2},
+		&ReqRdRegs{Holding: true, Addr: 195, Num: 2},
+		&ReqRdRegs{Holding: true, Addr: 205, Num: 1},
+		&ReqRdRegs{Holding: false, Addr: 110, Num: 4},
+	}
+	if !reflect.DeepEqual(pl.Reqs, expReqs) {
+		for _, r := range pl.Reqs {
+			t.Logf("  %+v", r)
+		}
+		t.Fatalf("Bad plan")
+	}
+
+	dev := &testDev{node: 0x01}
+	for i := range dev.hregs {
+		dev.hregs[i] = uint16(i)
+	}
+	dev.coils[10], dev.coils[12] = true, true
+	sp := &testSerPort{reply: dev.reply}
+	ress, errs := pl.Exec(newTestSerMaster(sp), 0x01)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Request %d failed: %s", i, err)
+		}
+	}
+	v, err := pl.Regs(ress, 3)
+	if err != nil || !reflect.DeepEqual(v, []uint16{110, 111, 112, 113}) {
+		t.Fatalf("Regs: %v, %v", v, err)
+	}
+	v, err = pl.Regs(ress, 6)
+	if err != nil || !reflect.DeepEqual(v, []uint16{101, 102}) {
+		t.Fatalf("Regs: %v, %v", v, err)
+	}
+	b, err := pl.Bits(ress, 7)
+	if err != nil || !reflect.DeepEqual(b, []bool{true, false, true}) {
+		t.Fatalf("Bits: %v, %v", b, err)
+	}
+	if _, err = pl.Bits(ress, 0); err != ErrResponse {
+		t.Fatalf("Bits on regs: Expected ErrResponse, got: %v", err)
+	}
+
+	if _, err = p.Plan([]Tag{{TblHoldingRegs, 199, 2}}); err != ErrRequest {
+		t.Fatalf("Tag in hole: Expected ErrRequest, got: %v", err)
+	}
+	if _, err = p.Plan([]Tag{{TblHoldingRegs, 0, 51}}); err != ErrRequest {
+		t.Fatalf("Tag too long: Expected ErrRequest, got: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PollValue is a value (or error) for a polled tag, delivered by the
+// Poller.
+type PollValue struct {
+	Node uint8
+	Tag  Tag
+	// Regs holds the register values (for register tags) and Bits
+	// the bit values (for coil and discrete-input tags). If Err is
+	// not nil, they hold the last good values read (if any) and
+	// QualStale is set.
+	Regs []uint16
+	Bits []bool
+	// Err is the error reading the tag failed with (if any).
+	Err error
+	// Quality flags, and exception code (if QualExc is set),
+	// derived from Err. See QualityOf.
+	Quality Quality
+	ExCode  ExCode
+	// Time the value was read (or reading it failed).
+	Time time.Time
+}
+
+// pollItem is a tag being polled.
+type pollItem struct {
+	node  uint8
+	tag   Tag
+	rbe   Filter
+	regs  []uint16 // last good values
+	bits  []bool
+	valid bool
+}
+
+// pollGroup is a group of tags, for the same node, polled with the
+// same period.
+type pollGroup struct {
+	node   uint8
+	period time.Duration
+	next   time.Time
+	items  []*pollItem
+}
+
+// Poller periodically reads (polls) tags from nodes using a Doer
+// (modbus master), each tag with its own scan period. Tags due to be
+// read at the same time are read together, using the minimum number
+// of requests (see Planner). Groups of tags with the same period are
+// spread (phased) evenly across the period, to distribute the load
+// on the bus. Values are delivered (to Notify or C) only when they
+// change by more than the tag's deadband, when their quality changes,
+// or when they have not been delivered for the deadband's MaxSilence
+// interval (see Deadband).
+//
+// When a group of tags cannot be read within its scan period (the bus
+// cannot keep up), an overrun is counted, the missed scans are
+// skipped, and Overrun is called (if not nil).
+//
+// Tags must be added, and exported fields must be set, before calling
+// Run.
+type Poller struct {
+	// Planner is used to coalesce tags into requests.
+	Planner Planner
+	// Notify, if not nil, is called (from the goroutine executing
+	// Run) with every new value.
+	Notify func(v PollValue)
+	// C, if not nil, and if Notify is nil, is where new values are
+	// sent to (blocking, until Run's context is done).
+	C chan PollValue
+	// Overrun, if not nil, is called when the group of tags for
+	// the given node and period cannot be read within the period.
+	Overrun func(node uint8, period time.Duration)
+
+	d        Doer
+	groups   []*pollGroup
+	mu       sync.Mutex
+	overruns uint64
+}
+
+// NewPoller returns a poller that issues requests using d.
+func NewPoller(d Doer) *Poller {
+	return &Poller{d: d}
+}
+
+// Add adds tag t, of the given node, to be polled with the given
+// period. Every change of the tag's value is reported. It returns
+// ErrRequest if the tag cannot be read with a single request (see
+// Planner.Plan), or if period is not positive.
+func (p *Poller) Add(node uint8, t Tag, period time.Duration) error {
+	return p.AddDeadband(node, t, period, Deadband{})
+}
+
+// AddDeadband is like Add, but changes of the tag's value are reported
+// according to deadband db.
+func (p *Poller) AddDeadband(node uint8, t Tag,
+	period time.Duration, db Deadband) error {
+	if period <= 0 {
+		return ErrRequest
+	}
+	if _, err := p.Planner.Plan([]Tag{t}); err != nil {
+		return err
+	}
+	it := &pollItem{node: node, tag: t, rbe: Filter{Deadband: db}}
+	for _, g := range p.groups {
+		if g.node == node && g.period == period {
+			g.items = append(g.items, it)
+			return nil
+		}
+	}
+	g := &pollGroup{node: node, period: period, items: []*pollItem{it}}
+	p.groups = append(p.groups, g)
+	return nil
+}
+
+// Overruns returns the number of overruns detected. It is ok to call
+// it while the poller is running.
+func (p *Poller) Overruns() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.overruns
+}
+
+// phase sets the first scan times for all groups, so that groups with
+// the same period are spread evenly across it.
+func (p *Poller) phase(now time.Time) {
+	byPeriod := make(map[time.Duration][]*pollGroup)
+	for _, g := range p.groups {
+		byPeriod[g.period] = append(byPeriod[g.period], g)
+	}
+	for period, gs := range byPeriod {
+		for i, g := range gs {
+			g.next = now.Add(period * time.Duration(i) /
+				time.Duration(len(gs)))
+		}
+	}
+}
+
+// deliver updates the last good value of it, sets the quality of v,
+// and delivers v if it passes the item's report-by-exception
+// filter. Delivery to C is abandoned if ctx is done.
+func (p *Poller) deliver(ctx context.Context, it *pollItem, v PollValue) {
+	v.Quality, v.ExCode = QualityOf(v.Err)
+	if v.Err == nil {
+		it.regs, it.bits, it.valid = v.Regs, v.Bits, true
+	} else {
+		v.Quality |= QualStale
+		if it.valid {
+			v.Regs, v.Bits = it.regs, it.bits
+		}
+	}
+	if !it.rbe.Pass(v) {
+		return
+	}
+	if p.Notify != nil {
+		p.Notify(v)
+	} else if p.C != nil {
+		select {
+		case p.C <- v:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// scan reads the tags in the given groups. Tags are coalesced per
+// node.
+func (p *Poller) scan(ctx context.Context, due []*pollGroup) {
+	byNode := make(map[uint8][]*pollItem)
+	var nodes []int
+	for _, g := range due {
+		if _, ok := byNode[g.node]; !ok {
+			nodes = append(nodes, int(g.node))
+		}
+		byNode[g.node] = append(byNode[g.node], g.items...)
+	}
+	sort.Ints(nodes)
+	for _, n := range nodes {
+		if ctx.Err() != nil {
+			return
+		}
+		node := uint8(n)
+		items := byNode[node]
+		tags := make([]Tag, len(items))
+		for i, it := range items {
+			tags[i] = it.tag
+		}
+		pl, err := p.Planner.Plan(tags)
+		if err != nil {
+			// Should not happen; tags are checked by Add.
+			continue
+		}
+		ress, errs := pl.Exec(p.d, node)
+		now := time.Now()
+		for i, it := range items {
+			v := PollValue{Node: node, Tag: it.tag, Time: now}
+			v.Err = errs[pl.Req(i)]
+			if v.Err == nil {
+				if it.tag.Table.IsBits() {
+					v.Bits, v.Err = pl.Bits(ress, i)
+				} else {
+					v.Regs, v.Err = pl.Regs(ress, i)
+				}
+				if v.Err != nil {
+					v.Regs, v.Bits = nil, nil
+				}
+			}
+			p.deliver(ctx, it, v)
+		}
+	}
+}
+
+// Run runs the poller until ctx is done, in which case it returns
+// nil. It is typical to execute this method in a separate goroutine.
+func (p *Poller) Run(ctx context.Context) error {
+	if len(p.groups) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	p.phase(time.Now())
+	tmr := time.NewTimer(0)
+	defer tmr.Stop()
+	for {
+		next := p.groups[0].next
+		for _, g := range p.groups[1:] {
+			if g.next.Before(next) {
+				next = g.next
+			}
+		}
+		if !tmr.Stop() {
+			select {
+			case <-tmr.C:
+			default:
+			}
+		}
+		tmr.Reset(next.Sub(time.Now()))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tmr.C:
+		}
+
+		now := time.Now()
+		var due []*pollGroup
+		for _, g := range p.groups {
+			if !g.next.After(now) {
+				due = append(due, g)
+			}
+		}
+		p.scan(ctx, due)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		end := time.Now()
+		for _, g := range due {
+			g.next = g.next.Add(g.period)
+			if g.next.After(end) {
+				continue
+			}
+			// Overrun. Skip missed scans.
+			n := end.Sub(g.next)/g.period + 1
+			g.next = g.next.Add(n * g.period)
+			p.mu.Lock()
+			p.overruns++
+			p.mu.Unlock()
+			if p.Overrun != nil {
+				p.Overrun(g.node, g.period)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// slowDoer passes requests to Doer d, after a delay.
+type slowDoer struct {
+	d     Doer
+	delay time.Duration
+}
+
+func (s *slowDoer) Do(node uint8, req Req, res Res) (Res, error) {
+	time.Sleep(s.delay)
+	return s.d.Do(node, req, res)
+}
+
+func TestPoller(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	dev.hregs[10] = 1
+	p := &testSerPort{reply: dev.reply}
+	pl := NewPoller(NewSerBus(newTestSerMaster(p)))
+	pl.C = make(chan PollValue, 16)
+	fast := Tag{TblHoldingRegs, 10, 1}
+	slow := Tag{TblCoils, 5, 2}
+	if err := pl.Add(0x01, fast, 10*time.Millisecond); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := pl.Add(0x01, slow, time.Hour); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := pl.Add(0x01, Tag{TblHoldingRegs, 0, 200}, time.Second); err != ErrRequest {
+		t.Fatalf("Add: Expected ErrRequest, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- pl.Run(ctx) }()
+
+	recv := func() PollValue {
+		select {
+		case v := <-pl.C:
+			if v.Err != nil {
+				t.Fatalf("Poll %+v: %s", v.Tag, v.Err)
+			}
+			return v
+		case <-time.After(time.Second):
+			t.Fatalf("No value received")
+		}
+		panic("not reached")
+	}
+	// Initial values
+	for i := 0; i < 2; i++ {
+		v := recv()
+		switch v.Tag {
+		case fast:
+			if v.Regs[0] != 1 {
+				t.Fatalf("Bad value: %v", v.Regs)
+			}
+		case slow:
+			if len(v.Bits) != 2 {
+				t.Fatalf("Bad value: %v", v.Bits)
+			}
+		default:
+			t.Fatalf("Bad tag: %+v", v.Tag)
+		}
+	}
+	// Change
+	dev.mu.Lock()
+	dev.hregs[10] = 2
+	dev.mu.Unlock()
+	v := recv()
+	if v.Tag != fast || v.Regs[0] != 2 {
+		t.Fatalf("Bad change: %+v", v)
+	}
+	select {
+	case v := <-pl.C:
+		t.Fatalf("Unexpected value: %+v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+}
+
+func TestPollerOverrun(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: dev.reply}
+	d := &slowDoer{d: newTestSerMaster(p), delay: 20 * time.Millisecond}
+	pl := NewPoller(d)
+	var overruns int
+	pl.Overrun = func(node uint8, period time.Duration) { overruns++ }
+	pl.Add(0x01, Tag{TblHoldingRegs, 0, 1}, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	pl.Run(ctx)
+	if overruns == 0 || uint64(overruns) != pl.Overruns() {
+		t.Fatalf("Bad overruns: %d, %d", overruns, pl.Overruns())
+	}
+}
+
+func TestPollerCancelBlocked(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: dev.reply}
+	pl := NewPoller(newTestSerMaster(p))
+	pl.C = make(chan PollValue) // Nobody reads it
+	pl.Add(0x01, Tag{TblHoldingRegs, 0, 1}, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- pl.Run(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run did not return")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import "time"
+
+// RetryPolicy decides if, and when, a failed request should be
+// retransmitted. See SerMaster.Retry.
+type RetryPolicy interface {
+	// Retry is called after the attempt-th transmission (counting
+	// from 1) of a request failed with error err. It returns true
+	// if the request should be retransmitted, and the delay to
+	// observe before retransmitting.
+	//
+	// The errors passed to Retry are: ErrTimeout, ErrFrame,
+	// ErrCRC, and exception responses (*ResExc, only when the
+	// request is issued with SerMaster.Do).
+	Retry(attempt int, err error) (retry bool, delay time.Duration)
+}
+
+// RetryBackoff is a RetryPolicy that retransmits requests that failed
+// due to communication errors (ErrTimeout, ErrFrame, ErrCRC) up to
+// Max times, with exponentially increasing delays: Delay before the
+// first retransmission, doubled for every subsequent one, up to
+// MaxDelay (if MaxDelay > 0). Exception responses are not retried.
+type RetryBackoff struct {
+	Max      int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+func (p RetryBackoff) Retry(attempt int, err error) (bool, time.Duration) {
+	if attempt > p.Max {
+		return false, 0
+	}
+	if err != ErrTimeout && err != ErrFrame && err != ErrCRC {
+		return false, 0
+	}
+	d := p.Delay
+	for i := 1; i < attempt; i++ {
+		if p.MaxDelay > 0 && d >= p.MaxDelay {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return true, d
+}
+
+// RetryBusy is a RetryPolicy that retransmits requests that were
+// replied with a "server busy" (SrvBusy) exception, up to Max times,
+// after waiting for Delay. Nothing else is retried. To also retry
+// communication errors, combine it with another policy in a
+// RetryChain.
+//
+// An "acknowledge" (SrvAck) exception is not retried: It means that
+// the slave accepted the request and is executing it, so
+// retransmitting the request would execute it again. After SrvAck,
+// callers must poll the slave for the completion of the operation
+// (e.g. by reading a status register), not retransmit the request.
+type RetryBusy struct {
+	Max   int
+	Delay time.Duration
+}
+
+func (p RetryBusy) Retry(attempt int, err error) (bool, time.Duration) {
+	if attempt > p.Max {
+		return false, 0
+	}
+	e, ok := err.(*ResExc)
+	if !ok || e.ExCode != SrvBusy {
+		return false, 0
+	}
+	return true, p.Delay
+}
+
+// RetryChain is a RetryPolicy that consults each policy in the chain,
+// in order, and retransmits the request according to the first one
+// that decides for a retransmission.
+type RetryChain []RetryPolicy
+
+func (c RetryChain) Retry(attempt int, err error) (bool, time.Duration) {
+	for _, p := range c {
+		if retry, d := p.Retry(attempt, err); retry {
+			return true, d
+		}
+	}
+	return false, 0
+}
+
+// retransCount is the RetryPolicy used by SerMaster when no policy is
+// set: Retransmits requests that failed due to communication errors,
+// up to n times, immediately.
+type retransCount int
+
+func (n retransCount) Retry(attempt int, err error) (bool, time.Duration) {
+	if attempt > int(n) || err == nil {
+		return false, 0
+	}
+	if err != ErrTimeout && err != ErrFrame && err != ErrCRC {
+		return false, 0
+	}
+	return true, 0
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryBackoff{Max: 4, Delay: 10 * time.Millisecond,
+		MaxDelay: 30 * time.Millisecond}
+	delays := []time.Duration{10, 20, 30, 30}
+	for i, d := range delays {
+		retry, delay := p.Retry(i+1, ErrTimeout)
+		if !retry || delay != d*time.Millisecond {
+			t.Fatalf("Attempt %d: %v, %s", i+1, retry, delay)
+		}
+	}
+	if retry, _ := p.Retry(5, ErrCRC); retry {
+		t.Fatalf("Retried after Max attempts")
+	}
+	if retry, _ := p.Retry(1, &ResExc{ExCode: SrvBusy}); retry {
+		t.Fatalf("Retried exception")
+	}
+}
+
+func TestRetryChain(t *testing.T) {
+	p := RetryChain{
+		RetryBusy{Max: 2, Delay: 5 * time.Millisecond},
+		RetryBackoff{Max: 1},
+	}
+	tests := []struct {
+		attempt int
+		err     error
+		retry   bool
+		delay   time.Duration
+	}{
+		{1, &ResExc{ExCode: SrvBusy}, true, 5 * time.Millisecond},
+		{2, &ResExc{ExCode: SrvBusy}, true, 5 * time.Millisecond},
+		{1, &ResExc{ExCode: SrvAck}, false, 0},
+		{3, &ResExc{ExCode: SrvBusy}, false, 0},
+		{1, &ResExc{ExCode: BadAddress}, false, 0},
+		{1, ErrFrame, true, 0},
+		{2, ErrFrame, false, 0},
+		{1, ErrTransmit, false, 0},
+	}
+	for i, tst := range tests {
+		retry, delay := p.Retry(tst.attempt, tst.err)
+		if retry != tst.retry || delay != tst.delay {
+			t.Fatalf("%d: %v, %s", i, retry, delay)
+		}
+	}
+}
+
+// busyDev wraps a testDev and replies with SrvBusy exceptions to the
+// first n requests.
+type busyDev struct {
+	testDev
+	n int
+}
+
+func (d *busyDev) reply(a SerADU) []byte {
+	if d.n > 0 && a.Node() == d.node {
+		d.n--
+		r, _ := SerPack(nil, d.node,
+			&ResExc{Function: a.FnCode(), ExCode: SrvBusy})
+		return r
+	}
+	return d.testDev.reply(a)
+}
+
+func TestSerMasterRetryBusy(t *testing.T) {
+	d := &busyDev{n: 2}
+	d.node = 0x01
+	d.hregs[10] = 0x1234
+	p := &testSerPort{reply: d.reply}
+	sm := newTestSerMaster(p)
+	req := &ReqRdRegs{Holding: true, Addr: 10, Num: 1}
+
+	// No policy: Exceptions are not retried
+	_, err := sm.Do(0x01, req, nil)
+	if e, ok := err.(*ResExc); !ok || e.ExCode != SrvBusy {
+		t.Fatalf("Expected SrvBusy, got: %v", err)
+	}
+
+	sm.Retry = RetryBusy{Max: 2, Delay: 5 * time.Millisecond}
+	start := time.Now()
+	res, err := sm.Do(0x01, req, nil)
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if v := res.(*ResRdRegs).Val; len(v) != 1 || v[0] != 0x1234 {
+		t.Fatalf("Bad response: %+v", res)
+	}
+	if dt := time.Since(start); dt < 5*time.Millisecond {
+		t.Fatalf("Retry delay not observed: %s", dt)
+	}
+	if len(d.reqs) != 1 {
+		t.Fatalf("Expected 1 request handled, got %d", len(d.reqs))
+	}
+}
+
+func TestSerMasterRetryTimeout(t *testing.T) {
+	p := &testSerPort{} // No slaves
+	sm := newTestSerMaster(p)
+	n := 0
+	sm.Retry = retryFunc(func(attempt int, err error) (bool, time.Duration) {
+		n++
+		if err != ErrTimeout {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		return attempt < 3, 0
+	})
+	_, err := sm.Do(0x01, &ReqResWrReg{}, nil)
+	if err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Expected policy consulted 3 times, got %d", n)
+	}
+}
+
+type retryFunc func(attempt int, err error) (bool, time.Duration)
+
+func (f retryFunc) Retry(attempt int, err error) (bool, time.Duration) {
+	return f(attempt, err)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"time"
+)
+
+// ScanStatus is the classification of a node's reply to a scan probe.
+type ScanStatus int
+
+const (
+	// ScanAbsent: No reply (timeout), or a gateway exception
+	// (GwPathNA, GwRespFail) reporting that the unit behind the
+	// gateway does not exist or did not reply.
+	ScanAbsent ScanStatus = iota
+	// ScanPresent: Normal reply.
+	ScanPresent
+	// ScanExc: Exception reply. The node is present, but does
+	// not support the probe request.
+	ScanExc
+	// ScanBad: Invalid reply (bad CRC, framing error, bad
+	// response). Something replied, but possibly with different
+	// line settings, or two nodes replied at once.
+	ScanBad
+)
+
+func (s ScanStatus) String() string {
+	switch s {
+	case ScanAbsent:
+		return "absent"
+	case ScanPresent:
+		return "present"
+	case ScanExc:
+		return "exception"
+	case ScanBad:
+		return "bad-reply"
+	default:
+		return "invalid"
+	}
+}
+
+// ScanResult is the result of probing a node.
+type ScanResult struct {
+	Node   uint8
+	Status ScanStatus
+	// Res is the response to the probe (if Status == ScanPresent)
+	Res Res
+	// Err is the error the probe failed with (if Status !=
+	// ScanPresent). For ScanExc, and for gateway exceptions, it
+	// is the exception (*ResExc).
+	Err error
+	// Time is the time it took to issue the probe and receive the
+	// reply (or to fail).
+	Time time.Duration
+}
+
+// Scanner discovers the nodes present on a bus (or the units behind a
+// TCP gateway), by probing each node id in a range with a harmless
+// request.
+type Scanner struct {
+	// Probe is the request used to probe nodes. If nil, a
+	// report-server-id request (ReqSlaveId) is used. Other good
+	// choices are a read-device-identification request
+	// (ReqRdDevId), or a read of a register known to exist.
+	Probe Req
+	// First and Last are the range of node ids to probe. If both
+	// are zero, ids 1 to 247 are probed.
+	First, Last uint8
+	// Notify, if not nil, is called with the result for every
+	// node, as soon as it becomes available.
+	Notify func(r ScanResult)
+}
+
+// contextDoer is implemented by masters that support cancellation
+// (SerMaster, TcpMaster).
+type contextDoer interface {
+	DoContext(ctx context.Context, node uint8, req Req, res Res) (Res, error)
+}
+
+// classify returns the scan status corresponding to probe error err,
+// or false if err is fatal (the scan cannot continue).
+func classify(err error) (ScanStatus, bool) {
+	switch err {
+	case nil:
+		return ScanPresent, true
+	case ErrTimeout:
+		return ScanAbsent, true
+	case ErrCRC, ErrFrame:
+		return ScanBad, true
+	}
+	if IsBadResponse(err) {
+		return ScanBad, true
+	}
+	if e, ok := err.(*ResExc); ok {
+		if e.ExCode == GwPathNA || e.ExCode == GwRespFail {
+			return ScanAbsent, true
+		}
+		return ScanExc, true
+	}
+	return ScanAbsent, false
+}
+
+// Scan probes the nodes in the scanner's range, in order, using Doer
+// d (a modbus master) and returns the results, one for every node
+// probed. Scan stops if ctx is done, or if a probe fails with an error
+// other than ErrTimeout, ErrCRC, ErrFrame, a bad response (see
+// IsBadResponse), or an exception (e.g. an ErrIO or ErrSync error).
+// In this case it returns the results for the nodes probed so far,
+// along with the error.
+// Cancellation takes effect immediately only if d supports it (has a
+// DoContext method, like SerMaster and TcpMaster), otherwise it takes
+// effect after the probe in progress completes.
+func (s *Scanner) Scan(ctx context.Context, d Doer) ([]ScanResult, error) {
+	probe := s.Probe
+	if probe == nil {
+		probe = &ReqSlaveId{}
+	}
+	first, last := int(s.First), int(s.Last)
+	if first == 0 && last == 0 {
+		first, last = 1, 247
+	}
+	cd, _ := d.(contextDoer)
+	var rs []ScanResult
+	for n := first; n <= last; n++ {
+		if err := ctx.Err(); err != nil {
+			return rs, err
+		}
+		if n == 0 {
+			// Cannot probe broadcast address
+			continue
+		}
+		node := uint8(n)
+		var res Res
+		var err error
+		start := time.Now()
+		if cd != nil {
+			res, err = cd.DoContext(ctx, node, probe, nil)
+		} else {
+			res, err = d.Do(node, probe, nil)
+		}
+		r := ScanResult{Node: node, Time: time.Since(start)}
+		st, ok := classify(err)
+		if !ok {
+			if cerr := ctx.Err(); cerr != nil {
+				err = cerr
+			}
+			return rs, err
+		}
+		r.Status = st
+		if st == ScanPresent {
+			r.Res = res
+		} else {
+			r.Err = err
+		}
+		rs = append(rs, r)
+		if s.Notify != nil {
+			s.Notify(r)
+		}
+	}
+	return rs, nil
+}
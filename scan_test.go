@@ -0,0 +1,150 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// scanBus returns a reply function for a bus with: a testDev at node
+// 3, a node at 5 that supports only report-server-id and
+// read-device-id, and a node at 7 that replies with bad CRCs.
+func scanBus() func(a SerADU) []byte {
+	dev := &testDev{node: 0x03}
+	return func(a SerADU) []byte {
+		switch a.Node() {
+		case 0x03:
+			return dev.reply(a)
+		case 0x05:
+			var res Res
+			switch a.FnCode() {
+			case SlaveId:
+				res = &ResSlaveId{Data: []byte{0x05, 0xff}}
+			case RdDevId:
+				res = &ResRdDevId{Code: DevIdBasic, Conformity: 0x01,
+					Objs: []DevIdObj{
+						{Id: 0x00, Val: []byte("ACME")},
+						{Id: 0x01, Val: []byte("X-100")},
+						{Id: 0x02, Val: []byte("1.0")}}}
+			default:
+				res = &ResExc{Function: a.FnCode(), ExCode: BadFnCode}
+			}
+			r, _ := SerPack(nil, 0x05, res)
+			return r
+		case 0x07:
+			r, _ := SerPack(nil, 0x07, &ResSlaveId{Data: []byte{0x07}})
+			r[len(r)-1] ^= 0xff
+			return r
+		}
+		return nil
+	}
+}
+
+func TestScan(t *testing.T) {
+	p := &testSerPort{reply: scanBus()}
+	sm := newTestSerMaster(p)
+	sc := &Scanner{First: 1, Last: 8}
+	var notified int
+	sc.Notify = func(r ScanResult) { notified++ }
+
+	rs, err := sc.Scan(context.Background(), sm)
+	if err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	if len(rs) != 8 || notified != 8 {
+		t.Fatalf("Expected 8 results, got %d (%d notified)",
+			len(rs), notified)
+	}
+	exp := map[uint8]ScanStatus{0x03: ScanExc, 0x05: ScanPresent,
+		0x07: ScanBad}
+	for _, r := range rs {
+		if r.Status != exp[r.Node] {
+			t.Fatalf("Node %d: expected %s, got %s (%v)",
+				r.Node, exp[r.Node], r.Status, r.Err)
+		}
+	}
+	res, ok := rs[4].Res.(*ResSlaveId)
+	if !ok || !bytes.Equal(res.Data, []byte{0x05, 0xff}) {
+		t.Fatalf("Bad response: %+v", rs[4].Res)
+	}
+
+	sc.Probe = &ReqRdDevId{Code: DevIdBasic}
+	rs, err = sc.Scan(context.Background(), sm)
+	if err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	di, ok := rs[4].Res.(*ResRdDevId)
+	if !ok || len(di.Objs) != 3 || string(di.Objs[1].Val) != "X-100" {
+		t.Fatalf("Bad response: %+v", rs[4].Res)
+	}
+
+	sc.Probe = &ReqRdRegs{Holding: true, Addr: 0, Num: 1}
+	rs, err = sc.Scan(context.Background(), sm)
+	if err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	if rs[2].Status != ScanPresent || rs[4].Status != ScanExc {
+		t.Fatalf("Bad results: %+v, %+v", rs[2], rs[4])
+	}
+}
+
+// gwDoer is a Doer that simulates a TCP gateway with a single unit
+// (id 2) behind it. Requests to unit 4 fail at the target, and
+// requests to all other units have no path.
+type gwDoer struct{}
+
+func (d gwDoer) Do(node uint8, req Req, res Res) (Res, error) {
+	switch node {
+	case 0x02:
+		return &ResSlaveId{Data: []byte{0x02, 0xff}}, nil
+	case 0x04:
+		return nil, &ResExc{Function: req.FnCode(), ExCode: GwRespFail}
+	}
+	return nil, &ResExc{Function: req.FnCode(), ExCode: GwPathNA}
+}
+
+func TestScanGateway(t *testing.T) {
+	sc := &Scanner{First: 1, Last: 5}
+	rs, err := sc.Scan(context.Background(), gwDoer{})
+	if err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	if len(rs) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(rs))
+	}
+	for _, r := range rs {
+		exp := ScanAbsent
+		if r.Node == 0x02 {
+			exp = ScanPresent
+		}
+		if r.Status != exp {
+			t.Fatalf("Node %d: expected %s, got %s (%v)",
+				r.Node, exp, r.Status, r.Err)
+		}
+	}
+	if e, ok := rs[3].Err.(*ResExc); !ok || e.ExCode != GwRespFail {
+		t.Fatalf("Bad error for node 4: %v", rs[3].Err)
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	p := &testSerPort{}
+	sm := newTestSerMaster(p)
+	sc := &Scanner{}
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.Notify = func(r ScanResult) {
+		if r.Node == 2 {
+			cancel()
+		}
+	}
+	rs, err := sc.Scan(ctx, sm)
+	if err != context.Canceled || len(rs) != 2 {
+		t.Fatalf("Expected 2 results and Canceled, got %d, %v",
+			len(rs), err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Request priorities for the serial bus arbiter (SerBus). Any int
+// value can be used as a priority. Requests with higher priority
+// values are served first.
+const (
+	SerBusPriLow    = -10
+	SerBusPriNormal = 0
+	SerBusPriHigh   = 10
+)
+
+// SerBus is a serial bus arbiter. It serializes access to a SerMaster
+// so that it can be safely shared among multiple goroutines. Requests
+// from all goroutines are queued, and served one at a time: Requests
+// with higher priority are served first. Among requests of the same
+// priority, nodes are served in a round-robin fashion (so that a
+// goroutine polling one node cannot monopolize the bus), and requests
+// to the same node are served in FIFO order.
+//
+// A request transaction in progress is never interrupted; a
+// high-priority request is served immediatelly after it
+// completes. Low-priority requests may starve if higher-priority
+// requests are continuously queued.
+//
+// Once a SerMaster is given to a SerBus, it must only be accessed
+// through the SerBus.
+type SerBus struct {
+	m     *SerMaster
+	mu    sync.Mutex
+	busy  bool
+	queue []*serBusTicket
+	last  uint8
+}
+
+// serBusTicket is a request waiting in the SerBus queue.
+type serBusTicket struct {
+	node  uint8
+	pri   int
+	ready chan struct{}
+}
+
+// NewSerBus returns a serial bus arbiter for master m.
+func NewSerBus(m *SerMaster) *SerBus {
+	return &SerBus{m: m}
+}
+
+// pick removes and returns the next ticket to be served from the
+// queue. The queue must not be empty.
+func (sb *SerBus) pick() *serBusTicket {
+	var sel int
+	for i, t := range sb.queue {
+		ts := sb.queue[sel]
+		if t.pri > ts.pri {
+			sel = i
+			continue
+		}
+		// Round-robin: Prefer the node with the smallest distance
+		// (modulo 256) after the last node served.
+		if t.pri == ts.pri && t.node-sb.last-1 < ts.node-sb.last-1 {
+			sel = i
+		}
+	}
+	t := sb.queue[sel]
+	copy(sb.queue[sel:], sb.queue[sel+1:])
+	sb.queue[len(sb.queue)-1] = nil
+	sb.queue = sb.queue[:len(sb.queue)-1]
+	return t
+}
+
+// remove removes ticket t from the queue. Returns false if t is not
+// in the queue (has already been picked).
+func (sb *SerBus) remove(t *serBusTicket) bool {
+	for i, ti := range sb.queue {
+		if ti == t {
+			copy(sb.queue[i:], sb.queue[i+1:])
+			sb.queue[len(sb.queue)-1] = nil
+			sb.queue = sb.queue[:len(sb.queue)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// acquire waits until the bus is granted to a request for the given
+// node, with the given priority. If the bus is not granted before the
+// deadline it returns ErrDeadline. A zero deadline means no
+// deadline. If ctx is done before the bus is granted, it returns
+// ctx.Err().
+func (sb *SerBus) acquire(ctx context.Context,
+	node uint8, pri int, deadline time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sb.mu.Lock()
+	if !sb.busy {
+		sb.busy = true
+		sb.last = node
+		sb.mu.Unlock()
+		return nil
+	}
+	t := &serBusTicket{node: node, pri: pri, ready: make(chan struct{})}
+	sb.queue = append(sb.queue, t)
+	sb.mu.Unlock()
+
+	var tmo <-chan time.Time
+	if !deadline.IsZero() {
+		tmr := time.NewTimer(deadline.Sub(time.Now()))
+		defer tmr.Stop()
+		tmo = tmr.C
+	}
+	var err error
+	select {
+	case <-t.ready:
+		return nil
+	case <-tmo:
+		err = ErrDeadline
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if !sb.remove(t) {
+		// Granted while giving-up. Take it.
+		return nil
+	}
+	return err
+}
+
+// release releases the bus and grants it to the next request in the
+// queue (if any).
+func (sb *SerBus) release() {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if len(sb.queue) == 0 {
+		sb.busy = false
+		return
+	}
+	t := sb.pick()
+	sb.last = t.node
+	close(t.ready)
+}
+
+// SndRcv queues the request ADU with normal priority (SerBusPriNormal)
+// and no deadline, waits for the bus, and then transmits the request
+// and receives the response using the SerMaster's SndRcv method. See
+// SerMaster.SndRcv for details.
+func (sb *SerBus) SndRcv(req SerADU, b []byte) (SerADU, error) {
+	return sb.SndRcvPri(req, b, SerBusPriNormal, time.Time{})
+}
+
+// SndRcvPri is like SndRcv, but the request is queued with the given
+// priority, and must be granted the bus before the given deadline, or
+// else SndRcvPri returns ErrDeadline (the request is not transmitted
+// in this case). A zero deadline means no deadline.
+func (sb *SerBus) SndRcvPri(req SerADU, b []byte,
+	pri int, deadline time.Time) (SerADU, error) {
+	return sb.sndRcv(context.Background(), req, b, pri, deadline)
+}
+
+// SndRcvContext is like SndRcvPri, but the request must be granted
+// the bus before ctx is done (or else SndRcvContext returns
+// ctx.Err()), and the transaction honors the cancellation and the
+// deadline of ctx. See SerMaster.SndRcvContext for details.
+func (sb *SerBus) SndRcvContext(ctx context.Context,
+	req SerADU, b []byte, pri int) (SerADU, error) {
+	return sb.sndRcv(ctx, req, b, pri, time.Time{})
+}
+
+func (sb *SerBus) sndRcv(ctx context.Context, req SerADU, b []byte,
+	pri int, deadline time.Time) (SerADU, error) {
+	if err := sb.acquire(ctx, req.Node(), pri, deadline); err != nil {
+		return b, err
+	}
+	defer sb.release()
+	return sb.m.SndRcvContext(ctx, req, b)
+}
+
+// Do queues request req for the given node with normal priority
+// (SerBusPriNormal) and no deadline, waits for the bus, transmits the
+// request, receives the response, and unpacks it in res. If res is
+// nil, a propper response type is allocated. See SerMaster.Do for
+// details.
+func (sb *SerBus) Do(node uint8, req Req, res Res) (Res, error) {
+	return sb.DoPri(node, req, res, SerBusPriNormal, time.Time{})
+}
+
+// DoPri is like Do, but the request is queued with the given
+// priority, and must be granted the bus before the given deadline, or
+// else DoPri returns ErrDeadline. A zero deadline means no deadline.
+func (sb *SerBus) DoPri(node uint8, req Req, res Res,
+	pri int, deadline time.Time) (Res, error) {
+	return sb.do(context.Background(), node, req, res, pri, deadline)
+}
+
+// DoContext is like DoPri, but the request must be granted the bus
+// before ctx is done (or else DoContext returns ctx.Err()), and the
+// transaction honors the cancellation and the deadline of ctx. See
+// SerMaster.DoContext for details.
+func (sb *SerBus) DoContext(ctx context.Context,
+	node uint8, req Req, res Res, pri int) (Res, error) {
+	return sb.do(ctx, node, req, res, pri, time.Time{})
+}
+
+func (sb *SerBus) do(ctx context.Context, node uint8, req Req, res Res,
+	pri int, deadline time.Time) (Res, error) {
+	if err := sb.acquire(ctx, node, pri, deadline); err != nil {
+		return nil, err
+	}
+	defer sb.release()
+	return sb.m.DoContext(ctx, node, req, res)
+}
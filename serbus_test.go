@@ -0,0 +1,82 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSerBusPick(t *testing.T) {
+	sb := NewSerBus(nil)
+	sb.last = 3
+	for _, tk := range []struct {
+		node uint8
+		pri  int
+	}{{1, 0}, {3, 0}, {5, 0}, {2, 0}, {5, 0}, {7, SerBusPriHigh}} {
+		sb.queue = append(sb.queue, &serBusTicket{node: tk.node, pri: tk.pri})
+	}
+	exp := []uint8{7, 1, 2, 3, 5, 5}
+	for i, n := range exp {
+		tk := sb.pick()
+		sb.last = tk.node
+		if tk.node != n {
+			t.Fatalf("Pick %d: node %d != %d", i, tk.node, n)
+		}
+	}
+}
+
+func TestSerBusConcurrent(t *testing.T) {
+	p := &testSerPort{reply: testEcho}
+	sb := NewSerBus(newTestSerMaster(p))
+
+	var wg sync.WaitGroup
+	for n := 1; n <= 8; n++ {
+		wg.Add(1)
+		go func(node uint8) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				req := &ReqResWrReg{Addr: uint16(node), Val: uint16(i)}
+				res, err := sb.Do(node, req, nil)
+				if err != nil {
+					t.Errorf("Node %d: %s", node, err)
+					return
+				}
+				if *res.(*ReqResWrReg) != *req {
+					t.Errorf("Node %d: Bad response: %+v",
+						node, res)
+					return
+				}
+			}
+		}(uint8(n))
+	}
+	wg.Wait()
+}
+
+func TestSerBusDeadline(t *testing.T) {
+	p := &testSerPort{reply: testEcho}
+	sb := NewSerBus(newTestSerMaster(p))
+
+	// Hold the bus
+	err := sb.acquire(context.Background(), 1, SerBusPriNormal, time.Time{})
+	if err != nil {
+		t.Fatalf("Acquire: %s", err)
+	}
+	dl := time.Now().Add(10 * time.Millisecond)
+	_, err = sb.DoPri(2, &ReqResWrReg{}, nil, SerBusPriHigh, dl)
+	if err != ErrDeadline {
+		t.Fatalf("Expected ErrDeadline, got: %v", err)
+	}
+	if len(sb.queue) != 0 {
+		t.Fatalf("Request left in queue")
+	}
+	sb.release()
+	if _, err = sb.Do(2, &ReqResWrReg{}, nil); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+}
@@ -7,6 +7,7 @@ package modbus
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"time"
 )
@@ -17,6 +18,7 @@ const (
 	DflSerMstTimeout      = 150 * time.Millisecond
 	DflSerMstFrameTimeout = 60 * time.Millisecond
 	DflSerMstSyncDelay    = DflSerMstTimeout
+	DflSerMstTurnaround   = 100 * time.Millisecond
 	// For slaves
 	DflSerSlvTimeout      = 100 * time.Millisecond
 	DflSerSlvFrameTimeout = 40 * time.Millisecond
@@ -70,7 +72,40 @@ type DeadlineWriter interface {
 // sizer calculates the size of modbus-serial ADUs. A new sizer (or
 // one initialized to zero) must be used for each ADU.
 type sizer struct {
-	sz int
+	sz  int
+	sil bool // Frame ends at silence. Then sz is the minimum size
+}
+
+// remain returns the remaining bytes for the partially received frame
+// in b, once the frame size (s.sz) is known. For frames that end at
+// silence, after the minimum size is reached, it returns the bytes
+// remaining up to the maximum ADU size.
+func (s *sizer) remain(b []byte) int {
+	if s.sil && len(b) >= s.sz {
+		return MaxSerADU - len(b)
+	}
+	return s.sz - len(b)
+}
+
+// atSilence returns true if b is a complete frame, provided that the
+// line becomes silent after it.
+func (s *sizer) atSilence(b []byte) bool {
+	return s.sil && len(b) >= s.sz
+}
+
+// sizeDiag sizes diagnostics requests and responses. All
+// sub-functions carry a single data word, except return-query-data,
+// which carries any number of them. A return-query-data frame cannot
+// be sized by its contents: It ends at silence.
+func (s *sizer) sizeDiag(b []byte) (remain int, ok bool) {
+	if len(b) < 4 {
+		return 4 - len(b), true
+	}
+	s.sz = 6 + SerCRCSz
+	if uint16(b[2])<<8|uint16(b[3]) == DiagQueryData {
+		s.sil = true
+	}
+	return s.remain(b), true
 }
 
 // sizeRes returns the remaining bytes for the patially received
@@ -78,7 +113,7 @@ type sizer struct {
 // (unsupported function code), it returns 0, false
 func (s *sizer) sizeRes(b []byte) (remain int, ok bool) {
 	if s.sz != 0 {
-		return s.sz - len(b), true
+		return s.remain(b), true
 	}
 	if len(b) < 5 {
 		return 5 - len(b), true
@@ -95,6 +130,8 @@ func (s *sizer) sizeRes(b []byte) (remain int, ok bool) {
 	case WrCoil, WrReg, WrCoils, WrRegs, GetComCnt:
 		s.sz = 6 + SerCRCSz
 		return s.sz - len(b), true
+	case Diag:
+		return s.sizeDiag(b)
 	case MskWrReg:
 		s.sz = 8 + SerCRCSz
 		return s.sz - len(b), true
@@ -104,6 +141,24 @@ func (s *sizer) sizeRes(b []byte) (remain int, ok bool) {
 	case RdFIFO:
 		s.sz = (int(b[2])<<8 | int(b[3])) + 3 + SerCRCSz
 		return s.sz - len(b), true
+	case RdDevId:
+		// Header: node, fn, mei, code, conformity, more,
+		// next-obj, num-objs. Then objects: id, len, value.
+		if len(b) < 8 {
+			return 8 - len(b), true
+		}
+		off := 8
+		for i := 0; i < int(b[7]); i++ {
+			if len(b) < off+2 {
+				return off + 2 - len(b), true
+			}
+			off += 2 + int(b[off+1])
+			if off+SerCRCSz > MaxSerADU {
+				return 0, false
+			}
+		}
+		s.sz = off + SerCRCSz
+		return s.sz - len(b), true
 	default:
 		return 0, false
 	}
@@ -114,7 +169,7 @@ func (s *sizer) sizeRes(b []byte) (remain int, ok bool) {
 // (unsupported function code), it returns 0, false
 func (s *sizer) sizeReq(b []byte) (remain int, ok bool) {
 	if s.sz != 0 {
-		return s.sz - len(b), true
+		return s.remain(b), true
 	}
 	if len(b) < 2 {
 		return 2 - len(b), true
@@ -142,8 +197,8 @@ func (s *sizer) sizeReq(b []byte) (remain int, ok bool) {
 		s.sz = 8 + SerCRCSz
 		return s.sz - len(b), true
 	case RdWrRegs:
-		if len(b) < 10 {
-			return 10 - len(b), true
+		if len(b) < 11 {
+			return 11 - len(b), true
 		}
 		s.sz = int(b[10]) + 11 + SerCRCSz
 		return s.sz - len(b), true
@@ -153,6 +208,8 @@ func (s *sizer) sizeReq(b []byte) (remain int, ok bool) {
 	case RdDevId:
 		s.sz = 5 + SerCRCSz
 		return s.sz - len(b), true
+	case Diag:
+		return s.sizeDiag(b)
 	default:
 		return 0, false
 	}
@@ -193,12 +250,21 @@ type SerReceiver interface {
 	// DeadlineReader wrapped in ErrIO. See specific
 	// implementation for more details.
 	Sync() error
+
+	// SyncContext is like Sync, but gives up when ctx is done, in
+	// which case it returns ctx.Err().
+	SyncContext(ctx context.Context) error
 }
 
 // SerReceiverRTU is the SerFrameReceiver implementation for
 // RTU-encoded ADUs. Exported fields can be changed between calls to
 // receiver methods. All have reasonable defaults.
 //
+// Frames are sized by their contents, except for return-query-data
+// diagnostics frames, which may carry any number of data words. These
+// are considered complete when the line remains silent for
+// FrameTimeout after them.
+//
 // For more details on timing parameters see the file
 // "rtu-timing.txt", distributed with the package sources.
 //
@@ -215,6 +281,7 @@ type SerReceiverRTU struct {
 	SyncWaitMax time.Duration
 	r           DeadlineReader
 	buf         [MaxSerADU]byte
+	first       time.Time
 }
 
 // NewSerReceiverRTU returns a new receiver for RTU-encoded ADUs.
@@ -276,8 +343,12 @@ func (rcv *SerReceiverRTU) receive(b []byte,
 	} else {
 		nrem, _ = sz.sizeRes(fr)
 	}
+	rcv.first = time.Time{}
 	for {
 		n, err := rcv.r.Read(be[:nrem])
+		if n > 0 && len(fr) == 0 {
+			rcv.first = time.Now()
+		}
 		be = be[n:]
 		fr = fr[:len(fr)+n]
 		var ok bool
@@ -296,6 +367,10 @@ func (rcv *SerReceiverRTU) receive(b []byte,
 		}
 		if err != nil {
 			if IsTimeout(err) {
+				if sz.atSilence(fr) {
+					// Frame ended at silence
+					break
+				}
 				// TODO(npat): Separate in-frame tmo?
 				return b, ErrTimeout
 			}
@@ -315,15 +390,31 @@ func (rcv *SerReceiverRTU) Buf() []byte {
 	return rcv.buf[0:0]
 }
 
+// FirstByte returns the time the first byte of the last frame was
+// received (approx.). Returns the zero time if no byte was received.
+func (rcv *SerReceiverRTU) FirstByte() time.Time {
+	return rcv.first
+}
+
 // Sync synchronizes the slave or master on the bus. Must be called
 // before the first request is transmitted (master) or before the
 // first frame is received (slave). Must also be called to
 // resynchronize the master or slave after a frame error (ErrFrame, or
 // ErrCRC).
 func (rcv *SerReceiverRTU) Sync() error {
+	return rcv.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync, but gives up when ctx is done, in which
+// case it returns ctx.Err(). Cancellation takes effect within
+// SyncDelay.
+func (rcv *SerReceiverRTU) SyncContext(ctx context.Context) error {
 	b := make([]byte, 16)
 	tend := time.Now().Add(rcv.SyncWaitMax)
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		rcv.r.SetReadDeadline(time.Now().Add(rcv.SyncDelay))
 		_, err := rcv.r.Read(b)
 		if err != nil {
@@ -5,7 +5,11 @@
 
 package modbus
 
-import "time"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 // SerMaster is a modbus-over-serial master (client). Exported fields
 // can be changed between calls to master methods. All have
@@ -16,18 +20,47 @@ type SerMaster struct {
 	// response byte.
 	Timeout time.Duration
 	// Number of request retransmission, if no response is
-	// received.
+	// received. Used only if Retry is nil.
 	Retrans int
+	// Broadcast turnaround delay. Time the bus is left idle after
+	// the transmission of a broadcast request, to allow the slaves
+	// to process it, before the next request is transmitted.
+	Turnaround time.Duration
+	// Retry, if not nil, is the policy that decides if and when
+	// failed requests are retransmitted. If nil, requests failed
+	// due to communication errors (ErrTimeout, ErrFrame, ErrCRC)
+	// are retransmitted immediately, up to Retrans times, and
+	// exception responses are not retried.
+	Retry RetryPolicy
+	// Adapt, if not nil, enables the derivation of per-node
+	// response timeouts from the nodes' response latency
+	// statistics. Per-node timeouts set with SetNodeTimeout take
+	// precedence. See AdaptTimeout.
+	Adapt *AdaptTimeout
+	// Lenient disables the validation of responses against
+	// requests, for all nodes (see also SetNodeLenient). By
+	// default, responses from nodes other than the one addressed,
+	// with function codes other than the one requested (checked
+	// by SndRcv and Do), or with contents that do not match the
+	// request (checked by Do: echoes, addresses, quantities, byte
+	// counts), are rejected with an *ErrMismatch error.
+	Lenient bool
+	// Health configures the node health state machine, and the
+	// rejection of requests to offline nodes. See HealthConf.
+	Health HealthConf
 
 	rcv    SerReceiver
 	trx    SerTransmitter
 	synced bool
+	quiet  time.Time // No transmissions before this
+	mu     sync.Mutex
+	nodes  map[uint8]*serNode
 }
 
 // NewSerMaster returns a modbus-over-serial master (client) that uses
 // the given serial receiver (rcv) and transmitter (trx).
 func NewSerMaster(rcv SerReceiver, trx SerTransmitter) *SerMaster {
-	return &SerMaster{rcv: rcv, trx: trx}
+	return &SerMaster{rcv: rcv, trx: trx, Turnaround: DflSerMstTurnaround}
 }
 
 // SerMasterConf are the modbus-over-serial master (client)
@@ -49,6 +82,9 @@ type SerMasterConf struct {
 	// Number of request retransmission, if no response is
 	// received.
 	Retrans int
+	// Broadcast turnaround delay. Time the bus is left idle after
+	// the transmission of a broadcast request.
+	Turnaround time.Duration
 	// Time the bus has to remain idle before the master is
 	// considered synchronized. The master synchronizes on the
 	// first call and after it detects a frame error or a bad
@@ -84,6 +120,9 @@ func NewSerMasterStd(conn DeadlineReadWriter, cfg SerMasterConf) *SerMaster {
 	if cfg.SyncDelay <= 0 {
 		cfg.SyncDelay = DflSerMstSyncDelay
 	}
+	if cfg.Turnaround <= 0 {
+		cfg.Turnaround = DflSerMstTurnaround
+	}
 	if cfg.SyncWaitMax <= 0 {
 		cfg.SyncWaitMax = DflSerSyncWaitMax
 	}
@@ -95,7 +134,6 @@ func NewSerMasterStd(conn DeadlineReadWriter, cfg SerMasterConf) *SerMaster {
 		rcv.FrameTimeout = cfg.FrameTimeout
 		rcv.SyncDelay = cfg.SyncDelay
 		rcv.SyncWaitMax = cfg.SyncWaitMax
-		sm.rcv = rcv
 		// Create and configure transmitter
 		trx := NewSerTransmitterRTU(conn)
 		trx.Baudrate = cfg.Baudrate
@@ -104,6 +142,7 @@ func NewSerMasterStd(conn DeadlineReadWriter, cfg SerMasterConf) *SerMaster {
 		sm = NewSerMaster(rcv, trx)
 		sm.Timeout = cfg.Timeout
 		sm.Retrans = cfg.Retrans
+		sm.Turnaround = cfg.Turnaround
 	}
 	return sm
 }
@@ -122,49 +161,162 @@ func NewSerMasterStd(conn DeadlineReadWriter, cfg SerMasterConf) *SerMaster {
 // wrapped in ErrIO. Of these ErrIO, and possibly ErrSync should be
 // considered fatal.
 func (sm *SerMaster) SndRcv(req SerADU, b []byte) (SerADU, error) {
-	var err error
-	for try := sm.Retrans + 1; try > 0; try-- {
-		// Sync to bus, if required
-		if !sm.synced {
-			if err = sm.rcv.Sync(); err != nil {
-				break
+	return sm.SndRcvContext(context.Background(), req, b)
+}
+
+// SndRcvContext is like SndRcv, but honors the cancellation and the
+// deadline of ctx. No (re)transmissions are attempted after the
+// context is done. The response reception deadline is not allowed to
+// extend beyond the context's deadline: If it expires while a
+// response is pending, the transaction is abandoned, and the master
+// re-synchronizes to the bus before its next transmission (since the
+// response may still arrive). Cancellation of a context without a
+// deadline takes effect after the pending response is received, or
+// times out. If the context is done, SndRcvContext returns
+// ctx.Err().
+func (sm *SerMaster) SndRcvContext(ctx context.Context,
+	req SerADU, b []byte) (SerADU, error) {
+	var attempt int
+	return sm.sndRcv(ctx, req, b, &attempt)
+}
+
+// policy returns the retry policy in effect.
+func (sm *SerMaster) policy() RetryPolicy {
+	if sm.Retry != nil {
+		return sm.Retry
+	}
+	return retransCount(sm.Retrans)
+}
+
+// sleepContext sleeps for duration d, or until ctx is done. Returns
+// ctx.Err().
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	tmr := time.NewTimer(d)
+	defer tmr.Stop()
+	select {
+	case <-tmr.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sndRcv transmits the request and receives the response,
+// retransmitting the request as decided by the retry policy. The
+// number of transmissions is accumulated in *attempt.
+func (sm *SerMaster) sndRcv(ctx context.Context,
+	req SerADU, b []byte, attempt *int) (SerADU, error) {
+	if err := sm.admit(req.Node()); err != nil {
+		return b, err
+	}
+	for {
+		a, err := sm.sndRcv1(ctx, req, b)
+		*attempt++
+		if err != ErrTimeout && err != ErrFrame && err != ErrCRC {
+			sm.outcome(req.Node(), err)
+			return a, err
+		}
+		retry, delay := sm.policy().Retry(*attempt, err)
+		if !retry {
+			sm.outcome(req.Node(), err)
+			return b, err
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return b, err
+		}
+		sm.count(req.Node(), MstCntRetry)
+	}
+}
+
+// sndRcv1 transmits the request and receives the response (a single
+// attempt).
+func (sm *SerMaster) sndRcv1(ctx context.Context,
+	req SerADU, b []byte) (SerADU, error) {
+	if err := ctx.Err(); err != nil {
+		return b, err
+	}
+	// Sync to bus, if required
+	if !sm.synced {
+		if err := sm.rcv.SyncContext(ctx); err != nil {
+			return b, err
+		}
+		sm.synced = true
+	}
+	// Observe broadcast turnaround delay, if required
+	if err := sleepContext(ctx, time.Until(sm.quiet)); err != nil {
+		return b, err
+	}
+	// Transmit request
+	deadline, err := sm.trx.Transmit(req)
+	if err != nil {
+		sm.synced = false
+		return b, err
+	}
+	sm.count(req.Node(), MstCntReq)
+	if req.Node() == 0x0 {
+		// Broadcast, no response
+		sm.quiet = time.Now().Add(sm.Turnaround)
+		return b, nil
+	}
+	// Receive response. Set receiver deadline (take into account
+	// the request transmission time)
+	start := deadline
+	tmo := sm.NodeTimeout(req.Node())
+	deadline = deadline.Add(tmo)
+	capped := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+		capped = true
+	}
+	a, err := sm.rcv.ReceiveRes(b, deadline)
+	if err != nil {
+		if err == ErrFrame || err == ErrCRC {
+			sm.synced = false
+			if err == ErrFrame {
+				sm.count(req.Node(), MstCntErrFrame)
+			} else {
+				sm.count(req.Node(), MstCntErrCRC)
 			}
-			sm.synced = true
+			return b, err
 		}
-		// Transmit request
-		var deadline time.Time
-		deadline, err = sm.trx.Transmit(req)
-		if err != nil {
+		if _, ok := err.(*ErrIO); ok {
 			sm.synced = false
-			break
+			return b, err
 		}
-		if req.Node() == 0x0 {
-			// Broadcast, no response
-			break
-		}
-		// Receive response
-		var a SerADU
-		// Set receiver deadline (take into account the
-		// request transmission time)
-		deadline = deadline.Add(sm.Timeout)
-		a, err = sm.rcv.ReceiveRes(b, deadline)
-		if err != nil {
-			if err == ErrFrame || err == ErrCRC {
-				sm.synced = false
-				continue
-			}
-			if _, ok := err.(*ErrIO); ok {
-				sm.synced = false
-				break
+		// Timeout
+		if capped || ctx.Err() != nil {
+			// Response may still arrive.
+			sm.synced = false
+			if err = ctx.Err(); err == nil {
+				err = context.DeadlineExceeded
 			}
-			// Timeout. Retry.
-			continue
+			return b, err
+		}
+		sm.timedOut(req.Node(), tmo)
+		if tmo < sm.Timeout {
+			// A late response may still arrive.
+			sm.synced = false
 		}
-		// Response ok
-		b = a
-		break
+		return b, err
 	}
-	return b, err
+	// Response ok
+	first := firstByte(sm.rcv, time.Now())
+	if !sm.lenient(req.Node()) {
+		if a.Node() != req.Node() {
+			sm.synced = false
+			sm.count(req.Node(), MstCntMismatch)
+			return b, mismatch(req.FnCode(), "reply from node %d", a.Node())
+		}
+		if a.FnCode() != req.FnCode() {
+			sm.count(req.Node(), MstCntMismatch)
+			return b, mismatch(req.FnCode(), "function code %s", a.FnCode())
+		}
+	}
+	sm.received(req.Node(), a, first.Sub(start))
+	return a, nil
 }
 
 // Do packs and transmits request req, receives a response, and
@@ -172,13 +324,63 @@ func (sm *SerMaster) SndRcv(req SerADU, b []byte) (SerADU, error) {
 // allocated. Do returns the unpacked response. On error it returns
 // nil and the error. Exception responses by the server are
 // considered, and returned as, errors (ResExc implements the error
-// interface).
+// interface). For broadcast requests (node == 0) no response is
+// received, and Do returns nil, nil on success. Only write requests
+// (see CanBroadcast) can be broadcast; Do returns ErrRequest for
+// others. After a broadcast, the bus is left idle for the Turnaround
+// delay.
+//
+// If a retry policy is set (see field Retry), requests replied with
+// exception responses are retransmitted if the policy decides so.
 //
 // Appart from exception responses from slaves, errors returned by Do
-// are: ErrRequest (bad reuest), ErrResponse (bad or invalid
-// response), ErrCommunication (cannot receive response), and any
-// error that may be returned by the DeadlineReadWriter, wrapped in
-// ErrIO.
+// are: ErrRequest (bad reuest), ErrResponse or *ErrMismatch (bad or
+// invalid response, see IsBadResponse), and any error returned by
+// SndRcv.
 func (sm *SerMaster) Do(node uint8, req Req, res Res) (Res, error) {
-	return nil, nil
+	return sm.DoContext(context.Background(), node, req, res)
+}
+
+// DoContext is like Do, but honors the cancellation and the deadline
+// of ctx. See SndRcvContext for details.
+func (sm *SerMaster) DoContext(ctx context.Context,
+	node uint8, req Req, res Res) (Res, error) {
+	var rb [MaxSerADU]byte
+	if node == 0 && !CanBroadcast(req.FnCode()) {
+		return nil, ErrRequest
+	}
+	a, err := SerPack(nil, node, req)
+	if err != nil {
+		return nil, ErrRequest
+	}
+	var attempt int
+	for {
+		r, err := sm.sndRcv(ctx, a, rb[:0], &attempt)
+		if err != nil {
+			return nil, err
+		}
+		if node == 0 {
+			// Broadcast, no response
+			return nil, nil
+		}
+		res1, err := unpackRes(r.PDU(), req.FnCode(), res)
+		if err == nil && !sm.lenient(node) {
+			if err := validateRes(req, res1); err != nil {
+				sm.count(node, MstCntMismatch)
+				return nil, err
+			}
+		}
+		exc, ok := err.(*ResExc)
+		if !ok || sm.Retry == nil {
+			return res1, err
+		}
+		retry, delay := sm.Retry.Retry(attempt, exc)
+		if !retry {
+			return nil, err
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+		sm.count(node, MstCntRetry)
+	}
 }
@@ -0,0 +1,75 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSerMasterDo(t *testing.T) {
+	p := &testSerPort{reply: testEcho}
+	sm := newTestSerMaster(p)
+
+	req := &ReqResWrCoil{Addr: 0x20, Status: true}
+	res, err := sm.Do(0x01, req, nil)
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if *res.(*ReqResWrCoil) != *req {
+		t.Fatalf("Bad response: %+v", res)
+	}
+	res, err = sm.Do(0x00, req, nil)
+	if err != nil || res != nil {
+		t.Fatalf("Broadcast: %v, %v", res, err)
+	}
+}
+
+func TestSerMasterDoContext(t *testing.T) {
+	p := &testSerPort{} // No slaves
+	sm := newTestSerMaster(p)
+	sm.Timeout = time.Second
+	sm.Retrans = 5
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := sm.DoContext(ctx, 0x01, &ReqResWrReg{}, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got: %v", err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("Context deadline not honored: %s", d)
+	}
+	_, err = sm.DoContext(ctx, 0x01, &ReqResWrReg{}, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestSerMasterBroadcast(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: dev.reply}
+	sm := newTestSerMaster(p)
+	sm.Turnaround = 30 * time.Millisecond
+
+	_, err := sm.Do(0x00, &ReqRdRegs{Holding: true, Num: 1}, nil)
+	if err != ErrRequest {
+		t.Fatalf("Expected ErrRequest, got: %v", err)
+	}
+	if _, err := sm.Do(0x00, &ReqResWrReg{Addr: 1, Val: 2}, nil); err != nil {
+		t.Fatalf("Broadcast: %s", err)
+	}
+	start := time.Now()
+	if _, err := sm.Do(0x01, &ReqRdRegs{Holding: true, Num: 1}, nil); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if d := time.Since(start); d < sm.Turnaround-5*time.Millisecond {
+		t.Fatalf("Turnaround delay not observed: %s", d)
+	}
+}
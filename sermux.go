@@ -0,0 +1,146 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"sort"
+	"sync"
+)
+
+// VirtSlave is a virtual slave device, served by a SerMux. Each
+// virtual slave has its own handler, identity, and counters.
+type VirtSlave struct {
+	node    uint8
+	handler SerHandler
+	ident   *DevIdent
+	cnt     counters
+}
+
+// Node returns the node id of the virtual slave.
+func (vs *VirtSlave) Node() uint8 { return vs.node }
+
+// Counter returns the counter indicated by argument cnt. Virtual
+// slaves keep the SlvCntSlvMsg, SlvCntSlvNoRes, SlvCntException, and
+// SlvCntSlvBusy counters; the rest (which concern the bus) are always
+// zero. It is ok to call this method while the slave is running.
+func (vs *VirtSlave) Counter(cnt Counter) uint64 {
+	return vs.cnt.Get(cnt)
+}
+
+// Counters returns all the counters of the virtual slave. Each array
+// slot is a counter. See SlvCntXXX constants for supported counters.
+func (vs *VirtSlave) Counters() []uint64 {
+	return vs.cnt.GetAll()
+}
+
+// handle handles request req, addressed to the virtual slave (or
+// broadcast, if node is zero), and returns the response.
+func (vs *VirtSlave) handle(node uint8, req Req) Res {
+	vs.cnt.Inc(SlvCntSlvMsg)
+	var res Res
+	if vs.ident != nil {
+		res = vs.ident.Handle(node, req)
+	}
+	if res == nil {
+		if vs.handler != nil {
+			res = vs.handler.Handle(node, req)
+		} else {
+			res = &ResExc{Function: req.FnCode(), ExCode: BadFnCode}
+		}
+	}
+	if node == 0 || res == nil {
+		vs.cnt.Inc(SlvCntSlvNoRes)
+		return nil
+	}
+	if e, ok := asExc(res); ok {
+		vs.cnt.Inc(SlvCntException)
+		if e.ExCode == SrvBusy {
+			vs.cnt.Inc(SlvCntSlvBusy)
+		}
+	}
+	return res
+}
+
+// SerMux is a SerHandler that dispatches requests to virtual slaves,
+// by node id. It allows a single SerSlave (with NodeId zero) to
+// emulate several slave devices on the bus. Requests addressed to
+// nodes with no virtual slave are not responded to; broadcasts are
+// passed to all virtual slaves. It is ok to add and remove virtual
+// slaves while the mux is being used by a slave.
+type SerMux struct {
+	mu     sync.RWMutex
+	slaves map[uint8]*VirtSlave
+}
+
+// NewSerMux returns a SerMux with no virtual slaves.
+func NewSerMux() *SerMux {
+	return &SerMux{slaves: make(map[uint8]*VirtSlave)}
+}
+
+// Add adds a virtual slave with the given node id, handler, and
+// identity. Report-server-id and read-device-identification requests
+// are answered using id (if not nil); all other requests are passed
+// to handler h. If h is nil, they are answered with BadFnCode
+// exceptions. It returns ErrNode if node is zero, or not available.
+func (m *SerMux) Add(node uint8, h SerHandler, id *DevIdent) (*VirtSlave, error) {
+	if node == 0 {
+		return nil, ErrNode
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.slaves[node]; ok {
+		return nil, ErrNode
+	}
+	vs := &VirtSlave{node: node, handler: h, ident: id}
+	vs.cnt.Init(SlvCntNum)
+	m.slaves[node] = vs
+	return vs, nil
+}
+
+// Remove removes the virtual slave with the given node id (if any).
+func (m *SerMux) Remove(node uint8) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.slaves, node)
+}
+
+// Slave returns the virtual slave with the given node id, or nil if
+// there is none.
+func (m *SerMux) Slave(node uint8) *VirtSlave {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.slaves[node]
+}
+
+// Slaves returns all the virtual slaves, sorted by node id.
+func (m *SerMux) Slaves() []*VirtSlave {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	vss := make([]*VirtSlave, 0, len(m.slaves))
+	for _, vs := range m.slaves {
+		vss = append(vss, vs)
+	}
+	sort.Slice(vss, func(i, j int) bool {
+		return vss[i].node < vss[j].node
+	})
+	return vss
+}
+
+// Handle passes request req to the virtual slave with the given node
+// id, and returns its response. See type SerMux.
+func (m *SerMux) Handle(node uint8, req Req) Res {
+	if node == 0 {
+		for _, vs := range m.Slaves() {
+			vs.handle(0, req)
+		}
+		return nil
+	}
+	vs := m.Slave(node)
+	if vs == nil {
+		return nil
+	}
+	return vs.handle(node, req)
+}
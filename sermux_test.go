@@ -0,0 +1,145 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestSerMux(t *testing.T) {
+	m := NewSerMux()
+	dm1 := NewDataModel(AddrRange{}, AddrRange{}, AddrRange{0, 10}, AddrRange{})
+	dm2 := NewDataModel(AddrRange{}, AddrRange{}, AddrRange{0, 10}, AddrRange{})
+	id := &DevIdent{SlaveId: []byte{0x42, 0xff}}
+	vs1, err := m.Add(1, dm1, id)
+	if err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	vs2, err := m.Add(2, dm2, nil)
+	if err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if _, err := m.Add(2, dm2, nil); err != ErrNode {
+		t.Fatalf("Add duplicate: %v", err)
+	}
+	if _, err := m.Add(0, dm2, nil); err != ErrNode {
+		t.Fatalf("Add broadcast: %v", err)
+	}
+	d := handlerDoer{m}
+	c := NewClient(d)
+
+	if err := c.WriteSingleRegister(1, 0, 1); err != nil {
+		t.Fatalf("WriteSingleRegister: %s", err)
+	}
+	if err := c.WriteSingleRegister(2, 0, 2); err != nil {
+		t.Fatalf("WriteSingleRegister: %s", err)
+	}
+	v1, _ := dm1.Regs(TblHoldingRegs, 0, 1)
+	v2, _ := dm2.Regs(TblHoldingRegs, 0, 1)
+	if v1[0] != 1 || v2[0] != 2 {
+		t.Fatalf("Bad values: %v %v", v1, v2)
+	}
+	if _, err := c.ReadHoldingRegisters(2, 20, 1); !isExc(err, BadAddress) {
+		t.Fatalf("Expected BadAddress, got: %v", err)
+	}
+	res, err := d.Do(1, &ReqSlaveId{}, nil)
+	if err != nil || !bytes.Equal(res.(*ResSlaveId).Data, id.SlaveId) {
+		t.Fatalf("ReqSlaveId: %v, %v", res, err)
+	}
+	if _, err := d.Do(2, &ReqSlaveId{}, nil); !isExc(err, BadFnCode) {
+		t.Fatalf("Expected BadFnCode, got: %v", err)
+	}
+	// Unknown node, broadcast
+	rdReq := &ReqRdRegs{Holding: true, Addr: 0, Num: 1}
+	if res := m.Handle(3, rdReq); res != nil {
+		t.Fatalf("Response from unknown node: %v", res)
+	}
+	wrReq := &ReqResWrReg{Addr: 1, Val: 7}
+	if res := m.Handle(0, wrReq); res != nil {
+		t.Fatalf("Response to broadcast: %v", res)
+	}
+	v1, _ = dm1.Regs(TblHoldingRegs, 1, 1)
+	v2, _ = dm2.Regs(TblHoldingRegs, 1, 1)
+	if v1[0] != 7 || v2[0] != 7 {
+		t.Fatalf("Broadcast not handled: %v %v", v1, v2)
+	}
+
+	exp1 := map[Counter]uint64{SlvCntSlvMsg: 3, SlvCntSlvNoRes: 1}
+	exp2 := map[Counter]uint64{SlvCntSlvMsg: 4, SlvCntSlvNoRes: 1,
+		SlvCntException: 2}
+	for _, x := range []struct {
+		vs  *VirtSlave
+		exp map[Counter]uint64
+	}{{vs1, exp1}, {vs2, exp2}} {
+		for c := Counter(0); c < SlvCntNum; c++ {
+			if n := x.vs.Counter(c); n != x.exp[c] {
+				t.Errorf("Node %d: counter %d = %d, expected %d",
+					x.vs.Node(), c, n, x.exp[c])
+			}
+		}
+	}
+
+	m.Remove(1)
+	if vss := m.Slaves(); len(vss) != 1 || vss[0] != vs2 {
+		t.Fatalf("Slaves: %v", vss)
+	}
+}
+
+func TestDevIdent(t *testing.T) {
+	big := bytes.Repeat([]byte{'x'}, 200)
+	id := &DevIdent{Objs: []DevIdObj{
+		{DevIdVendorName, []byte("ACME")},
+		{DevIdProductCode, []byte("P1")},
+		{DevIdMajorMinorRevision, []byte("1.0")},
+		{DevIdProductName, big},
+		{0x80, big},
+	}}
+	d := handlerDoer{id}
+	rd := func(code, obj uint8) (*ResRdDevId, error) {
+		res, err := d.Do(1, &ReqRdDevId{Code: code, ObjId: obj}, nil)
+		if err != nil {
+			return nil, err
+		}
+		return res.(*ResRdDevId), nil
+	}
+	ids := func(objs []DevIdObj) []uint8 {
+		var r []uint8
+		for _, o := range objs {
+			r = append(r, o.Id)
+		}
+		return r
+	}
+
+	r, err := rd(DevIdBasic, 0)
+	if err != nil || r.Conformity != 0x83 || r.More ||
+		!reflect.DeepEqual(ids(r.Objs), []uint8{0, 1, 2}) {
+		t.Fatalf("Basic: %+v, %v", r, err)
+	}
+	// Extended does not fit in one response
+	r, err = rd(DevIdExtended, 0)
+	if err != nil || !r.More || r.NextObj != 0x80 ||
+		!reflect.DeepEqual(ids(r.Objs), []uint8{0, 1, 2, 4}) {
+		t.Fatalf("Extended: %+v, %v", r, err)
+	}
+	r, err = rd(DevIdExtended, r.NextObj)
+	if err != nil || r.More || !reflect.DeepEqual(ids(r.Objs), []uint8{0x80}) {
+		t.Fatalf("Extended, next: %+v, %v", r, err)
+	}
+	// Unknown start object: restart from the beginning
+	r, err = rd(DevIdRegular, 0x03)
+	if err != nil || !reflect.DeepEqual(ids(r.Objs), []uint8{0, 1, 2, 4}) {
+		t.Fatalf("Regular: %+v, %v", r, err)
+	}
+	r, err = rd(DevIdIndividual, DevIdProductCode)
+	if err != nil || len(r.Objs) != 1 || string(r.Objs[0].Val) != "P1" {
+		t.Fatalf("Individual: %+v, %v", r, err)
+	}
+	if _, err := rd(DevIdIndividual, 0x05); !isExc(err, BadAddress) {
+		t.Fatalf("Expected BadAddress, got: %v", err)
+	}
+}
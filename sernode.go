@@ -0,0 +1,384 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"sort"
+	"time"
+)
+
+// Per-node counters kept by the serial master. See
+// SerMaster.NodeStats.
+const (
+	// Requests transmitted (including retransmissions)
+	MstCntReq Counter = iota
+	// Responses received (normal or exception)
+	MstCntRes
+	// Response timeouts
+	MstCntTimeout
+	// Responses with bad CRC
+	MstCntErrCRC
+	// Responses with framing errors
+	MstCntErrFrame
+	// Responses that do not match the request (see ErrMismatch).
+	// Responses from other nodes, or with other function codes,
+	// are not counted as received (MstCntRes).
+	MstCntMismatch
+	// Exception responses
+	MstCntException
+	// Request retransmissions (decided by the retry policy)
+	MstCntRetry
+
+	MstCntNum = iota
+)
+
+// Health is the health state of a node, as seen by the master.
+type Health int
+
+const (
+	// Node replies normally
+	HealthOnline Health = iota
+	// Last transaction(s) with the node failed
+	HealthDegraded
+	// Many consecutive transactions with the node failed
+	HealthOffline
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthOnline:
+		return "online"
+	case HealthDegraded:
+		return "degraded"
+	case HealthOffline:
+		return "offline"
+	default:
+		return "invalid"
+	}
+}
+
+// HealthConf configures the node health state machine of the serial
+// master. A transaction (request transmission, and possible
+// retransmissions) fails if no valid response is received (timeout,
+// bad CRC, framing error). Exception responses are not failures. A
+// successful transaction makes the node HealthOnline. DegradedAfter
+// consecutive failed transactions make the node HealthDegraded, and
+// OfflineAfter make it HealthOffline.
+//
+// If BackoffMin > 0, requests to offline nodes are rejected with
+// ErrOffline (without being transmitted), except for one request
+// every backoff interval, which probes the node. The backoff
+// interval starts at BackoffMin, and doubles with every failed probe,
+// up to BackoffMax.
+type HealthConf struct {
+	// If zero, 1 is used
+	DegradedAfter int
+	// If zero, 3 is used
+	OfflineAfter int
+	// If zero, requests to offline nodes are not rejected
+	BackoffMin time.Duration
+	// If zero, 32 * BackoffMin is used
+	BackoffMax time.Duration
+}
+
+// fix returns a copy of hc with zero values replaced by defaults.
+func (hc HealthConf) fix() HealthConf {
+	c := hc
+	if c.DegradedAfter <= 0 {
+		c.DegradedAfter = 1
+	}
+	if c.OfflineAfter <= 0 {
+		c.OfflineAfter = 3
+	}
+	if c.BackoffMax <= 0 {
+		c.BackoffMax = 32 * c.BackoffMin
+	}
+	return c
+}
+
+// NodeStats is a snapshot of the statistics and the health state the
+// master keeps for a node.
+type NodeStats struct {
+	Node uint8
+	// Counters, indexed by MstCntXXX constants.
+	Cnt [MstCntNum]uint64
+	// Exception responses received, by exception code.
+	Exc map[ExCode]uint64
+	// Response latency statistics.
+	Latency LatencyStats
+	// Health state, time it was entered, and number of
+	// consecutive failed transactions.
+	Health Health
+	Since  time.Time
+	Fails  int
+}
+
+// serNode is per-node master state
+type serNode struct {
+	cnt     [MstCntNum]uint64
+	exc     map[ExCode]uint64
+	lat     latency
+	est     latency       // As lat, plus timeouts (see AdaptTimeout)
+	tmo     time.Duration // Timeout override, if > 0
+	lenient bool
+	health  Health
+	since   time.Time
+	fails   int
+	backoff time.Duration
+	retryAt time.Time
+}
+
+// node returns the state for the given node. Must be called with
+// sm.mu held.
+func (sm *SerMaster) node(node uint8) *serNode {
+	if sm.nodes == nil {
+		sm.nodes = make(map[uint8]*serNode)
+	}
+	n, ok := sm.nodes[node]
+	if !ok {
+		n = &serNode{since: time.Now()}
+		sm.nodes[node] = n
+	}
+	return n
+}
+
+// count increments counter cnt for the given node.
+func (sm *SerMaster) count(node uint8, cnt Counter) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.node(node).cnt[cnt]++
+}
+
+// received records the reception of response a, with latency d, from
+// the given node.
+func (sm *SerMaster) received(node uint8, a SerADU, d time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n := sm.node(node)
+	n.cnt[MstCntRes]++
+	if a.IsExc() {
+		n.cnt[MstCntException]++
+		if n.exc == nil {
+			n.exc = make(map[ExCode]uint64)
+		}
+		n.exc[a.ExCode()]++
+	}
+	n.lat.n++
+	n.lat.hist[latencyBucket(d)]++
+	n.lat.add(d)
+	n.est.add(d)
+}
+
+// timedOut records a response timeout for the given node. Timeout tmo
+// (but no less than SerMinTimeout) is recorded as a sample for the
+// timeout estimation (see AdaptTimeout), but not in the latency
+// statistics.
+func (sm *SerMaster) timedOut(node uint8, tmo time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n := sm.node(node)
+	n.cnt[MstCntTimeout]++
+	n.lat.timeouts++
+	if tmo < SerMinTimeout {
+		tmo = SerMinTimeout
+	}
+	n.est.add(tmo)
+}
+
+// setHealth changes the health state of n. Must be called with sm.mu
+// held.
+func (n *serNode) setHealth(h Health, now time.Time) {
+	if n.health != h {
+		n.health, n.since = h, now
+	}
+}
+
+// admit returns ErrOffline if a request to the given node must be
+// rejected, because the node is offline (see HealthConf).
+func (sm *SerMaster) admit(node uint8) error {
+	if node == 0 || sm.Health.BackoffMin <= 0 {
+		return nil
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n, ok := sm.nodes[node]
+	if !ok || n.health != HealthOffline {
+		return nil
+	}
+	if time.Now().Before(n.retryAt) {
+		return ErrOffline
+	}
+	return nil
+}
+
+// outcome updates the health state of the given node, according to
+// the error err a transaction with it completed with.
+func (sm *SerMaster) outcome(node uint8, err error) {
+	if node == 0 {
+		return
+	}
+	if err != nil && err != ErrTimeout && err != ErrCRC && err != ErrFrame {
+		// Not the node's fault
+		return
+	}
+	hc := sm.Health.fix()
+	now := time.Now()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n := sm.node(node)
+	if err == nil {
+		n.fails, n.backoff = 0, 0
+		n.setHealth(HealthOnline, now)
+		return
+	}
+	n.fails++
+	switch {
+	case n.fails >= hc.OfflineAfter:
+		if n.health == HealthOffline {
+			n.backoff *= 2
+			if n.backoff > hc.BackoffMax {
+				n.backoff = hc.BackoffMax
+			}
+		} else {
+			n.backoff = hc.BackoffMin
+		}
+		n.retryAt = now.Add(n.backoff)
+		n.setHealth(HealthOffline, now)
+	case n.fails >= hc.DegradedAfter:
+		n.setHealth(HealthDegraded, now)
+	}
+}
+
+// SetNodeTimeout sets the response timeout for the given node,
+// overriding Timeout and the timeout derived from latency statistics
+// (if Adapt is set). A tmo <= 0 removes the override. It is ok to
+// call it concurrently with other master methods.
+func (sm *SerMaster) SetNodeTimeout(node uint8, tmo time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.node(node).tmo = tmo
+}
+
+// SetNodeLenient disables (if lenient is true) or enables the
+// validation of responses from the given node. See field Lenient. It
+// is ok to call it concurrently with other master methods.
+func (sm *SerMaster) SetNodeLenient(node uint8, lenient bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.node(node).lenient = lenient
+}
+
+// lenient returns true if responses from the given node must not be
+// validated.
+func (sm *SerMaster) lenient(node uint8) bool {
+	if sm.Lenient {
+		return true
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n, ok := sm.nodes[node]
+	return ok && n.lenient
+}
+
+// NodeTimeout returns the response timeout in effect for the given
+// node. It is ok to call it concurrently with other master methods.
+func (sm *SerMaster) NodeTimeout(node uint8) time.Duration {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n, ok := sm.nodes[node]
+	if !ok {
+		return sm.Timeout
+	}
+	if n.tmo > 0 {
+		return n.tmo
+	}
+	if sm.Adapt != nil {
+		return sm.Adapt.timeout(&n.est, sm.Timeout)
+	}
+	return sm.Timeout
+}
+
+// Latency returns the response latency statistics for the given
+// node. It is ok to call it concurrently with other master methods.
+func (sm *SerMaster) Latency(node uint8) LatencyStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n, ok := sm.nodes[node]
+	if !ok {
+		return LatencyStats{}
+	}
+	return n.lat.stats()
+}
+
+// NodeHealth returns the health state of the given node. Nodes never
+// addressed are HealthOnline. It is ok to call it concurrently with
+// other master methods.
+func (sm *SerMaster) NodeHealth(node uint8) Health {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n, ok := sm.nodes[node]
+	if !ok {
+		return HealthOnline
+	}
+	return n.health
+}
+
+// stats returns a snapshot of the statistics of n. Must be called
+// with sm.mu held.
+func (n *serNode) stats(node uint8) NodeStats {
+	st := NodeStats{Node: node, Cnt: n.cnt, Latency: n.lat.stats(),
+		Health: n.health, Since: n.since, Fails: n.fails}
+	if n.exc != nil {
+		st.Exc = make(map[ExCode]uint64, len(n.exc))
+		for k, v := range n.exc {
+			st.Exc[k] = v
+		}
+	}
+	return st
+}
+
+// NodeStats returns a snapshot of the statistics for the given
+// node. It is ok to call it concurrently with other master methods.
+func (sm *SerMaster) NodeStats(node uint8) NodeStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	n, ok := sm.nodes[node]
+	if !ok {
+		return NodeStats{Node: node}
+	}
+	return n.stats(node)
+}
+
+// Stats returns a snapshot of the statistics for all nodes addressed
+// so far, sorted by node id. It is ok to call it concurrently with
+// other master methods.
+func (sm *SerMaster) Stats() []NodeStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sts := make([]NodeStats, 0, len(sm.nodes))
+	for id, n := range sm.nodes {
+		sts = append(sts, n.stats(id))
+	}
+	sort.Slice(sts, func(i, j int) bool {
+		return sts[i].Node < sts[j].Node
+	})
+	return sts
+}
+
+// ResetStats resets the counters and the latency statistics for all
+// nodes. Health states and timeout overrides are not affected, but
+// adapted timeouts (see AdaptTimeout) are re-learned. It is ok to
+// call it concurrently with other master methods.
+func (sm *SerMaster) ResetStats() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, n := range sm.nodes {
+		n.cnt = [MstCntNum]uint64{}
+		n.exc = nil
+		n.lat = latency{}
+		n.est = latency{}
+	}
+}
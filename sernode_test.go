@@ -0,0 +1,108 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSerMasterStats(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: dev.reply}
+	sm := newTestSerMaster(p)
+	sm.Retrans = 1
+
+	for i := 0; i < 3; i++ {
+		if _, err := sm.Do(0x01, &ReqRdRegs{Num: 1}, nil); err != nil {
+			t.Fatalf("Do: %s", err)
+		}
+	}
+	if _, err := sm.Do(0x01, &ReqSlaveId{}, nil); err == nil {
+		t.Fatalf("Expected exception")
+	}
+	if _, err := sm.Do(0x02, &ReqRdRegs{Num: 1}, nil); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got: %v", err)
+	}
+
+	st := sm.NodeStats(0x01)
+	if st.Cnt[MstCntReq] != 4 || st.Cnt[MstCntRes] != 4 ||
+		st.Cnt[MstCntException] != 1 || st.Exc[BadFnCode] != 1 ||
+		st.Latency.N != 4 || st.Health != HealthOnline {
+		t.Fatalf("Bad stats for node 1: %+v", st)
+	}
+	var nh uint64
+	for _, n := range st.Latency.Hist {
+		nh += n
+	}
+	if nh != 4 {
+		t.Fatalf("Bad latency histogram: %v", st.Latency.Hist)
+	}
+	st = sm.NodeStats(0x02)
+	if st.Cnt[MstCntReq] != 2 || st.Cnt[MstCntTimeout] != 2 ||
+		st.Cnt[MstCntRetry] != 1 || st.Health != HealthDegraded ||
+		st.Fails != 1 {
+		t.Fatalf("Bad stats for node 2: %+v", st)
+	}
+	if sts := sm.Stats(); len(sts) != 2 || sts[0].Node != 0x01 {
+		t.Fatalf("Bad stats: %+v", sts)
+	}
+	sm.ResetStats()
+	if st := sm.NodeStats(0x01); st.Cnt[MstCntReq] != 0 || st.Latency.N != 0 {
+		t.Fatalf("Stats not reset: %+v", st)
+	}
+}
+
+func TestSerMasterHealth(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	alive := false
+	p := &testSerPort{reply: func(a SerADU) []byte {
+		if !alive {
+			return nil
+		}
+		return dev.reply(a)
+	}}
+	sm := newTestSerMaster(p)
+	sm.Health = HealthConf{OfflineAfter: 2, BackoffMin: 50 * time.Millisecond}
+	req := &ReqRdRegs{Num: 1}
+
+	for i, h := range []Health{HealthDegraded, HealthOffline} {
+		if _, err := sm.Do(0x01, req, nil); err != ErrTimeout {
+			t.Fatalf("%d: Expected ErrTimeout, got: %v", i, err)
+		}
+		if sm.NodeHealth(0x01) != h {
+			t.Fatalf("%d: Expected %s, got %s", i, h, sm.NodeHealth(0x01))
+		}
+	}
+	// Offline: Rejected without transmission
+	if _, err := sm.Do(0x01, req, nil); err != ErrOffline {
+		t.Fatalf("Expected ErrOffline, got: %v", err)
+	}
+	if n := sm.NodeStats(0x01).Cnt[MstCntReq]; n != 2 {
+		t.Fatalf("Expected 2 requests, got %d", n)
+	}
+	// Probe after backoff
+	time.Sleep(60 * time.Millisecond)
+	if _, err := sm.Do(0x01, req, nil); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got: %v", err)
+	}
+	if _, err := sm.Do(0x01, req, nil); err != ErrOffline {
+		t.Fatalf("Expected ErrOffline, got: %v", err)
+	}
+	// Backoff doubled
+	alive = true
+	time.Sleep(60 * time.Millisecond)
+	if _, err := sm.Do(0x01, req, nil); err != ErrOffline {
+		t.Fatalf("Expected ErrOffline, got: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := sm.Do(0x01, req, nil); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if st := sm.NodeStats(0x01); st.Health != HealthOnline || st.Fails != 0 {
+		t.Fatalf("Expected online: %+v", st)
+	}
+}
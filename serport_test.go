@@ -0,0 +1,219 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tmoError struct{}
+
+func (e tmoError) Error() string   { return "i/o timeout" }
+func (e tmoError) Timeout() bool   { return true }
+func (e tmoError) Temporary() bool { return true }
+
+// testSerPort is a fake serial port (DeadlineReadWriter) with
+// simulated slaves attached to it. Every frame written to the port is
+// passed to reply, and whatever reply returns becomes available for
+// reading.
+type testSerPort struct {
+	mu    sync.Mutex
+	rbuf  bytes.Buffer
+	rdl   time.Time
+	ntmo  int // Read timeouts so far
+	reply func(req SerADU) []byte
+}
+
+func (p *testSerPort) Read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		if p.rbuf.Len() > 0 {
+			n, err := p.rbuf.Read(b)
+			p.mu.Unlock()
+			return n, err
+		}
+		dl := p.rdl
+		if !dl.IsZero() && time.Now().After(dl) {
+			p.ntmo++
+			p.mu.Unlock()
+			return 0, tmoError{}
+		}
+		p.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (p *testSerPort) Write(b []byte) (int, error) {
+	req := append(SerADU(nil), b...)
+	var res []byte
+	if p.reply != nil {
+		res = p.reply(req)
+	}
+	p.mu.Lock()
+	p.rbuf.Write(res)
+	p.mu.Unlock()
+	return len(b), nil
+}
+
+// Inject makes b available for reading, as if transmitted by some
+// other node on the bus.
+func (p *testSerPort) Inject(b []byte) {
+	p.mu.Lock()
+	p.rbuf.Write(b)
+	p.mu.Unlock()
+}
+
+// WaitTimeout waits until more than n reads from the port have timed
+// out. Receivers end synchronization with a read timeout, so
+// WaitTimeout(0) on a fresh port waits for the receiver attached to
+// it to sync. Returns false if this does not happen within a second.
+func (p *testSerPort) WaitTimeout(n int) bool {
+	tend := time.Now().Add(time.Second)
+	for time.Now().Before(tend) {
+		if p.Timeouts() > n {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+// Timeouts returns the number of reads from the port that have timed
+// out so far.
+func (p *testSerPort) Timeouts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ntmo
+}
+
+func (p *testSerPort) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.rdl = t
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *testSerPort) SetWriteDeadline(t time.Time) error { return nil }
+
+// testPack packs r in a serial ADU for the given node, failing the
+// test on error.
+func testPack(t *testing.T, node uint8, r ReqRes) []byte {
+	b, err := SerPack(nil, node, r)
+	if err != nil {
+		t.Fatalf("Cannot pack %T: %s", r, err)
+	}
+	return b
+}
+
+// newTestSerMaster returns a master, with fast timing parameters,
+// attached to port p.
+func newTestSerMaster(p *testSerPort) *SerMaster {
+	rcv := NewSerReceiverRTU(p)
+	rcv.SyncDelay = 2 * time.Millisecond
+	rcv.FrameTimeout = 10 * time.Millisecond
+	trx := NewSerTransmitterRTU(p)
+	trx.Delay = 0
+	sm := NewSerMaster(rcv, trx)
+	sm.Timeout = 20 * time.Millisecond
+	return sm
+}
+
+// testEcho is a reply function for testSerPort that echoes requests
+// to nodes other than 0.
+func testEcho(req SerADU) []byte {
+	if req.Node() == 0 {
+		return nil
+	}
+	return req
+}
+
+// testDev is a simulated slave device for testSerPort, with 64K coils,
+// discrete inputs, holding and input registers. Requests to other
+// nodes, and broadcasts, are ignored (not replied).
+type testDev struct {
+	mu    sync.Mutex
+	node  uint8
+	coils [0x10000]bool
+	ins   [0x10000]bool
+	hregs [0x10000]uint16
+	iregs [0x10000]uint16
+	reqs  []Req
+}
+
+func (d *testDev) handle(req Req) Res {
+	d.reqs = append(d.reqs, req)
+	switch r := req.(type) {
+	case *ReqRdInputs:
+		v := make([]bool, r.Num)
+		for i := range v {
+			if r.Coils {
+				v[i] = d.coils[int(r.Addr)+i]
+			} else {
+				v[i] = d.ins[int(r.Addr)+i]
+			}
+		}
+		return &ResRdInputs{Coils: r.Coils, BitStat: packBits(v)}
+	case *ReqRdRegs:
+		v := make([]uint16, r.Num)
+		for i := range v {
+			if r.Holding {
+				v[i] = d.hregs[int(r.Addr)+i]
+			} else {
+				v[i] = d.iregs[int(r.Addr)+i]
+			}
+		}
+		return &ResRdRegs{Holding: r.Holding, Val: v}
+	case *ReqResWrCoil:
+		d.coils[r.Addr] = r.Status
+		return r
+	case *ReqResWrReg:
+		d.hregs[r.Addr] = r.Val
+		return r
+	case *ReqWrCoils:
+		for i := 0; i < int(r.Num); i++ {
+			d.coils[int(r.Addr)+i] = r.Status(i)
+		}
+		return &ResWrCoils{Addr: r.Addr, Num: r.Num}
+	case *ReqWrRegs:
+		copy(d.hregs[r.Addr:], r.Val)
+		return &ResWrRegs{Addr: r.Addr, Num: uint16(len(r.Val))}
+	case *ReqResMskWrReg:
+		v := d.hregs[r.Addr]
+		d.hregs[r.Addr] = v&r.AndMsk | r.OrMsk&^r.AndMsk
+		return r
+	case *ReqRdWrRegs:
+		copy(d.hregs[r.WrAddr:], r.WrVal)
+		v := make([]uint16, r.RdNum)
+		copy(v, d.hregs[r.RdAddr:])
+		return &ResRdWrRegs{Val: v}
+	default:
+		return &ResExc{Function: req.FnCode(), ExCode: BadFnCode}
+	}
+}
+
+// reply is a reply function for testSerPort.
+func (d *testDev) reply(a SerADU) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if a.Node() != d.node {
+		return nil
+	}
+	req, err := NewReq(a.FnCode())
+	if err != nil {
+		return nil
+	}
+	if _, err := req.Unpack(a.PDU()); err != nil {
+		return nil
+	}
+	res, err := SerPack(nil, d.node, d.handle(req))
+	if err != nil {
+		return nil
+	}
+	return res
+}
@@ -120,3 +120,39 @@ func TestSerReceiverRTUSimple(t *testing.T) {
 		}
 	}
 }
+
+func TestSerReceiverRTUQueryData(t *testing.T) {
+	for _, req := range []bool{true, false} {
+		r := &ReqResDiag{Sub: DiagQueryData, Data: []uint16{1, 2, 3}}
+		a, err := SerPack(nil, 0x01, r)
+		if err != nil {
+			t.Fatalf("Cannot pack %T: %s", r, err)
+		}
+		p := &testSerPort{}
+		p.Inject(a)
+		rcv := NewSerReceiverRTU(p)
+		rcv.FrameTimeout = 5 * time.Millisecond
+		var b SerADU
+		dl := time.Now().Add(time.Second)
+		if req {
+			b, err = rcv.ReceiveReq(nil, dl)
+		} else {
+			b, err = rcv.ReceiveRes(nil, dl)
+		}
+		if err != nil || !bytes.Equal(a, b) {
+			t.Fatalf("Bad query-data frame (req: %v): %x, %v",
+				req, b, err)
+		}
+
+		// Followed by another frame, without silence
+		a1, _ := SerPack(a, 0x01, &ReqResWrReg{Addr: 1, Val: 2})
+		if l := frameLen(a1, req); l != len(a) {
+			t.Fatalf("Bad frame length (req: %v): %d != %d",
+				req, l, len(a))
+		}
+		if l := frameLen(a[:len(a)-1], req); l != -1 {
+			t.Fatalf("Bad partial frame length (req: %v): %d",
+				req, l)
+		}
+	}
+}
@@ -5,7 +5,11 @@
 
 package modbus
 
-import "time"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 type SerHandler interface {
 	Handle(node uint8, req Req) Res
@@ -18,6 +22,13 @@ type SerHandlerRaw interface {
 // SerSlave is a modbus-over-serial slave (server). Exported fields
 // can be changed between calls to master methods. All have reasonable
 // defaults.
+//
+// If NodeId is not zero, the slave itself answers diagnostics
+// requests (function Diag), returning its counters, and implementing
+// the listen-only mode and the restart-communications option (see
+// ForceListenOnly and Restart). Otherwise they are passed to the
+// handlers, except while the slave is in listen-only mode: Then a
+// restart-communications request, to any node, takes it out of it.
 type SerSlave struct {
 	// Node-Id this slave responds to. If zero, all request are
 	// passed to the handler, which decides to process and respond
@@ -30,17 +41,56 @@ type SerSlave struct {
 	// request. With both handlers non-nil, Handler is used.
 	Handler    SerHandler
 	HandlerRaw SerHandlerRaw
+	// Response timeout. Counting approx. from the *end* of the
+	// request reception, until the reception of the first
+	// response byte (from another slave).
+	Timeout time.Duration
 
 	rcv    SerReceiver
 	trx    SerTransmitter
 	synced bool
 	cnt    counters
+	reqBuf [MaxSerADU]byte
+	resBuf [MaxSerADU]byte
+
+	mu     sync.Mutex
+	listen bool   // Listen-only mode
+	events []byte // Comm. event log, most recent first
 }
 
+// Size of the communication event log. See SerSlave.Events.
+const SlvEventLogSz = 64
+
+// Communication event log entries, and flags. See [1],§6.10,pg.27
+const (
+	// Receive event. Flags: SlvEvRcvXXX
+	SlvEvRcv byte = 0x80
+	// Send event. Flags: SlvEvSndXXX
+	SlvEvSnd byte = 0x40
+	// Entered listen-only mode
+	SlvEvListenOnly byte = 0x04
+	// Communication restart
+	SlvEvRestart byte = 0x00
+
+	SlvEvRcvCommErr    byte = 0x02
+	SlvEvRcvOverrun    byte = 0x10
+	SlvEvRcvListenOnly byte = 0x20
+	SlvEvRcvBroadcast  byte = 0x40
+
+	SlvEvSndReadExc    byte = 0x01 // Exception codes 1-3
+	SlvEvSndAbortExc   byte = 0x02 // Exception code 4
+	SlvEvSndBusyExc    byte = 0x04 // Exception codes 5-6
+	SlvEvSndNAKExc     byte = 0x08 // Exception code 7
+	SlvEvSndWrTmo      byte = 0x10
+	SlvEvSndListenOnly byte = 0x20
+)
+
 // NewSerSlave returns a modbus-over-serial slave (server) that uses
 // the given serial receiver (rcv) and transmitter (trx).
-func NewSerSlave(rcv SerReceiver, trx SerTransmitter) {
-	return &SerSlave{rcv: rcv, trx: trx}
+func NewSerSlave(rcv SerReceiver, trx SerTransmitter) *SerSlave {
+	ss := &SerSlave{rcv: rcv, trx: trx, Timeout: DflSerSlvTimeout}
+	ss.cnt.Init(SlvCntNum)
+	return ss
 }
 
 // SerSlaveConf are the modbus-over-serial slave (server)
@@ -58,6 +108,8 @@ type SerSlaveConf struct {
 	// request. With both handlers non-nil, Handler is used.
 	Handler    SerHandler
 	HandlerRaw SerHandlerRaw
+	// Serial bus bitrate. Used for timeout calculations
+	Baudrate int
 	// Response timeout. Counting approx. from the *end* of the
 	// request transmission, until the reception of the first
 	// response byte.
@@ -88,6 +140,9 @@ type SerSlaveConf struct {
 func NewSerSlaveStd(conn DeadlineReadWriter, cfg SerSlaveConf) *SerSlave {
 	var ss *SerSlave
 	// Fixup params
+	if cfg.Baudrate <= 0 {
+		cfg.Baudrate = DflSerBaudrate
+	}
 	if cfg.Timeout <= 0 {
 		cfg.Timeout = DflSerSlvTimeout
 	}
@@ -112,7 +167,6 @@ func NewSerSlaveStd(conn DeadlineReadWriter, cfg SerSlaveConf) *SerSlave {
 		rcv.FrameTimeout = cfg.FrameTimeout
 		rcv.SyncDelay = cfg.SyncDelay
 		rcv.SyncWaitMax = cfg.SyncWaitMax
-		ss.rcv = rcv
 		// Create and configure transmitter
 		trx := NewSerTransmitterRTU(conn)
 		trx.Baudrate = cfg.Baudrate
@@ -120,15 +174,15 @@ func NewSerSlaveStd(conn DeadlineReadWriter, cfg SerSlaveConf) *SerSlave {
 		// Create and configure slave
 		ss = NewSerSlave(rcv, trx)
 		ss.NodeId = cfg.NodeId
-		ss.SerHandler = cfg.SerHandler
-		ss.SerHandlerRaw = cfg.SerHandlerRaw
+		ss.Handler = cfg.Handler
+		ss.HandlerRaw = cfg.HandlerRaw
 		ss.Timeout = cfg.Timeout
 	}
-	ss.cnt.Init(SlvCntNum)
+	return ss
 }
 
 func (ss *SerSlave) handle(reqADU SerADU) SerADU {
-	resADU := SerADU(ss.resBuf[:])
+	resADU := SerADU(ss.resBuf[:0])
 	if ss.Handler == nil {
 		if ss.HandlerRaw != nil {
 			return ss.HandlerRaw.Handle(reqADU, resADU)
@@ -144,7 +198,7 @@ func (ss *SerSlave) handle(reqADU SerADU) SerADU {
 		resADU, _ = SerPack(resADU, node, &exc)
 		return resADU
 	}
-	_, err = req.Unpack(reqADU)
+	_, err = req.Unpack(reqADU.PDU())
 	if err != nil {
 		exc.ExCode = BadValue
 		resADU, _ = SerPack(resADU, node, &exc)
@@ -166,18 +220,8 @@ func (ss *SerSlave) handle(reqADU SerADU) SerADU {
 // TODO(npat): Add echo-mode support?
 
 func (ss *SerSlave) transmit(res SerADU) error {
-	// Transmit timeout, just in case. Should never expire.
-	const txTmo = 2 * time.Second
-	// Observe delay
-	if ss.Delay > 0 {
-		time.Sleep(ss.Delay)
-	}
-	ss.conn.SetWriteDeadline(time.Now().Add(txTmo))
-	_, err := ss.conn.Write(res)
-	if err != nil {
-		return wErrIO(err)
-	}
-	return nil
+	_, err := ss.trx.Transmit(res)
+	return err
 }
 
 // Start starts the slave. The slave is considered running after
@@ -186,39 +230,60 @@ func (ss *SerSlave) transmit(res SerADU) error {
 // the DeadlineReadWriter used by the transmitter and receiver, and
 // wait for Start to return.
 func (ss *SerSlave) Start() error {
+	return ss.ServeContext(context.Background())
+}
+
+// ServeContext is like Start, but the slave can also be stopped by
+// canceling ctx (or when the context's deadline expires). In this
+// case ServeContext returns nil. Cancellation takes effect after the
+// request transaction in progress (if any) completes; while the slave
+// is idle it takes effect within approx. one second.
+func (ss *SerSlave) ServeContext(ctx context.Context) error {
 	// Wait for request timeout. Go back waiting if it expires.
 	const reqTmo = 1 * time.Second
 	var err error
 	for {
+		if ctx.Err() != nil {
+			return nil
+		}
 		if !ss.synced {
-			err = ss.rcv.Sync()
+			err = ss.rcv.SyncContext(ctx)
 			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
 				break
 			}
 			ss.synced = true
 		}
-		reqADU := SerADU(ss.reqBuf[:])
+		reqADU := SerADU(ss.reqBuf[:0])
 		// Receive request
-		reqADU, err = ss.rcv.ReceiveReq(reqADU, time.Now().Add(reqTmo))
+		deadline := time.Now().Add(reqTmo)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		reqADU, err = ss.rcv.ReceiveReq(reqADU, deadline)
 		if err != nil {
 			if _, ok := err.(*ErrIO); ok {
 				break
 			}
 			if err == ErrFrame || err == ErrCRC {
 				ss.synced = false
+				ss.rcvError(err)
 			}
 			// Timeout (??) next request
 			continue
 		}
+		ss.cnt.Inc(SlvCntBusMsg)
 		if reqADU.Node() == 0x00 {
 			// Boadcast, ignore response
-			_ = ss.handle(reqADU)
+			_ = ss.process(reqADU)
 			// Next request
 			continue
 		}
 		if ss.NodeId == 0 || ss.NodeId == reqADU.Node() {
 			// Ours, probably
-			resADU := ss.handle(reqADU)
+			resADU := ss.process(reqADU)
 			if resADU != nil {
 				// Ours, transmit response
 				err = ss.transmit(resADU)
@@ -230,8 +295,8 @@ func (ss *SerSlave) Start() error {
 			}
 		}
 		// Not ours, receive response
-		resADU := SerADU(ss.resBuf[:])
-		deadline := time.Now().Add(ss.Timeout)
+		resADU := SerADU(ss.resBuf[:0])
+		deadline = time.Now().Add(ss.Timeout)
 		resADU, err = ss.rcv.ReceiveRes(resADU, deadline)
 		if err != nil {
 			if _, ok := err.(*ErrIO); ok {
@@ -239,14 +304,230 @@ func (ss *SerSlave) Start() error {
 			}
 			if err == ErrFrame || err == ErrCRC {
 				ss.synced = false
+				ss.rcvError(err)
 			}
 			// Timeout, next request
 			continue
 		}
+		ss.cnt.Inc(SlvCntBusMsg)
 	}
 	return err
 }
 
+// process processes request reqADU, received by the slave, and
+// returns the response (nil if there is none, or if the request is
+// not for the slave). It handles diagnostics requests and the
+// listen-only mode, passing all other requests to the handlers.
+func (ss *SerSlave) process(reqADU SerADU) SerADU {
+	node := reqADU.Node()
+	listen := ss.ListenOnly()
+	var resADU SerADU
+	switch {
+	case reqADU.FnCode() == Diag && (ss.NodeId != 0 || listen):
+		resADU = ss.diag(reqADU, listen)
+	case listen:
+		resADU = nil
+	default:
+		resADU = ss.handle(reqADU)
+	}
+	if node != 0 && ss.NodeId == 0 && resADU == nil {
+		// Maybe not ours
+		return nil
+	}
+	ss.account(node, listen, resADU)
+	if node == 0 {
+		return nil
+	}
+	return resADU
+}
+
+// account updates the counters and the event log, for a request
+// for the slave, with response resADU (nil if there is none).
+func (ss *SerSlave) account(node uint8, listen bool, resADU SerADU) {
+	ss.cnt.Inc(SlvCntSlvMsg)
+	rev, sev := SlvEvRcv, SlvEvSnd
+	if listen {
+		rev |= SlvEvRcvListenOnly
+		sev |= SlvEvSndListenOnly
+	}
+	if node == 0 {
+		rev |= SlvEvRcvBroadcast
+	}
+	if node == 0 || resADU == nil {
+		ss.cnt.Inc(SlvCntSlvNoRes)
+	} else if resADU.IsExc() {
+		ss.cnt.Inc(SlvCntException)
+		switch ec := resADU.ExCode(); {
+		case ec <= BadValue:
+			sev |= SlvEvSndReadExc
+		case ec == SrvFail:
+			sev |= SlvEvSndAbortExc
+		case ec == SrvAck || ec == SrvBusy:
+			sev |= SlvEvSndBusyExc
+			if ec == SrvBusy {
+				ss.cnt.Inc(SlvCntSlvBusy)
+			}
+		case ec == srvNAK:
+			sev |= SlvEvSndNAKExc
+			ss.cnt.Inc(SlvCntSlvNAK)
+		}
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.logEvent(rev)
+	ss.logEvent(sev)
+}
+
+// srvNAK is the (obsolete) negative-acknowledge exception code
+const srvNAK ExCode = 0x07
+
+// rcvError updates the counters and the event log, for a frame
+// received with error err.
+func (ss *SerSlave) rcvError(err error) {
+	if err != ErrCRC {
+		return
+	}
+	ss.cnt.Inc(SlvCntErrCRC)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ev := SlvEvRcv | SlvEvRcvCommErr
+	if ss.listen {
+		ev |= SlvEvRcvListenOnly
+	}
+	ss.logEvent(ev)
+}
+
+// logEvent adds event ev to the event log. Must be called with ss.mu
+// held.
+func (ss *SerSlave) logEvent(ev byte) {
+	if len(ss.events) < SlvEventLogSz {
+		ss.events = append(ss.events, 0)
+	}
+	copy(ss.events[1:], ss.events)
+	ss.events[0] = ev
+}
+
+// diag handles diagnostics request reqADU, and returns the response
+// (nil if there is none). If listen is true, the slave is in
+// listen-only mode, and only restart-communications requests are
+// processed (without a response).
+func (ss *SerSlave) diag(reqADU SerADU, listen bool) SerADU {
+	var r ReqResDiag
+	exc := ResExc{Function: Diag}
+	resADU := SerADU(ss.resBuf[:0])
+	if _, err := r.Unpack(reqADU.PDU()); err != nil {
+		if listen {
+			return nil
+		}
+		exc.ExCode = BadValue
+		resADU, _ = SerPack(resADU, reqADU.Node(), &exc)
+		return resADU
+	}
+	if listen && r.Sub != DiagRestartComm {
+		return nil
+	}
+	cnt := func(c Counter) {
+		r.Data = []uint16{uint16(ss.cnt.Get(c))}
+	}
+	switch r.Sub {
+	case DiagQueryData:
+		// Echo request
+	case DiagRestartComm:
+		if len(r.Data) != 1 || (r.Data[0] != 0x0000 && r.Data[0] != 0xff00) {
+			exc.ExCode = BadValue
+			break
+		}
+		ss.Restart(r.Data[0] == 0xff00)
+		if listen {
+			return nil
+		}
+	case DiagRdDiagReg:
+		r.Data = []uint16{0}
+	case DiagListenOnly:
+		ss.ForceListenOnly()
+		return nil
+	case DiagClearCnt:
+		ss.cnt.RstAll()
+	case DiagBusMsgCnt:
+		cnt(SlvCntBusMsg)
+	case DiagBusErrCnt:
+		cnt(SlvCntErrCRC)
+	case DiagBusExcCnt:
+		cnt(SlvCntException)
+	case DiagSlvMsgCnt:
+		cnt(SlvCntSlvMsg)
+	case DiagSlvNoResCnt:
+		cnt(SlvCntSlvNoRes)
+	case DiagSlvNAKCnt:
+		cnt(SlvCntSlvNAK)
+	case DiagSlvBusyCnt:
+		cnt(SlvCntSlvBusy)
+	case DiagOverrunCnt:
+		cnt(SlvCntOverrun)
+	case DiagClearOverrun:
+		ss.cnt.Rst(SlvCntOverrun)
+	default:
+		exc.ExCode = BadFnCode
+	}
+	if exc.ExCode != 0 {
+		resADU, _ = SerPack(resADU, reqADU.Node(), &exc)
+		return resADU
+	}
+	resADU, _ = SerPack(resADU, reqADU.Node(), &r)
+	return resADU
+}
+
+// ForceListenOnly puts the slave in listen-only mode, as if it had
+// received a force-listen-only-mode diagnostics request. In this
+// mode the slave keeps monitoring the bus, and updating its counters
+// and event log, but it does not pass requests to the handlers, and
+// it does not respond to them. The only request processed is the
+// restart-communications-option diagnostics request, which (like
+// calling Restart) takes the slave out of listen-only mode. It is ok
+// to call this method while the slave is running.
+func (ss *SerSlave) ForceListenOnly() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if !ss.listen {
+		ss.listen = true
+		ss.logEvent(SlvEvListenOnly)
+	}
+}
+
+// ListenOnly returns true if the slave is in listen-only mode. It is
+// ok to call this method while the slave is running.
+func (ss *SerSlave) ListenOnly() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.listen
+}
+
+// Restart restarts the slave's communications, as if it had received
+// a restart-communications-option diagnostics request: It takes the
+// slave out of listen-only mode, and clears all the counters. If
+// clearLog is true, it also clears the event log. A restart event is
+// logged. It is ok to call this method while the slave is running.
+func (ss *SerSlave) Restart(clearLog bool) {
+	ss.cnt.RstAll()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.listen = false
+	if clearLog {
+		ss.events = nil
+	}
+	ss.logEvent(SlvEvRestart)
+}
+
+// Events returns the communication event log, most recent event
+// first. Each event is a byte, as described in [1],§6.10,pg.27 (see
+// SlvEvXXX constants). The log holds up to SlvEventLogSz events. It is
+// ok to call this method while the slave is running.
+func (ss *SerSlave) Events() []byte {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return append([]byte(nil), ss.events...)
+}
+
 // Counter returns the counter indicated by argument cnt. See
 // SlvCntXXX constants for suppported counters. It is ok to call this
 // method while the slave is running.
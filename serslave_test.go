@@ -0,0 +1,217 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testHandler struct{}
+
+func (h testHandler) Handle(node uint8, req Req) Res {
+	switch r := req.(type) {
+	case *ReqResWrReg:
+		return r
+	default:
+		return &ResExc{Function: req.FnCode(), ExCode: BadFnCode}
+	}
+}
+
+// newTestSerSlave returns a slave, with fast timing parameters,
+// attached to port p.
+func newTestSerSlave(p *testSerPort, node uint8) *SerSlave {
+	rcv := NewSerReceiverRTU(p)
+	rcv.SyncDelay = 2 * time.Millisecond
+	rcv.FrameTimeout = 10 * time.Millisecond
+	trx := NewSerTransmitterRTU(p)
+	trx.Delay = 0
+	ss := NewSerSlave(rcv, trx)
+	ss.NodeId = node
+	ss.Timeout = 10 * time.Millisecond
+	return ss
+}
+
+func TestSerSlaveServeContext(t *testing.T) {
+	var got SerADU
+	rcvd := make(chan struct{})
+	p := &testSerPort{}
+	p.reply = func(res SerADU) []byte {
+		got = res
+		close(rcvd)
+		return nil
+	}
+	ss := newTestSerSlave(p, 0x01)
+	ss.Handler = testHandler{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ss.ServeContext(ctx) }()
+
+	if !p.WaitTimeout(0) {
+		t.Fatalf("Slave did not sync")
+	}
+	req, _ := SerPack(nil, 0x01, &ReqResWrReg{Addr: 1, Val: 2})
+	p.Inject(req)
+	select {
+	case <-rcvd:
+	case <-time.After(time.Second):
+		t.Fatalf("No response")
+	}
+	if string(got) != string(req) {
+		t.Fatalf("Bad response: %x != %x", got, req)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ServeContext: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ServeContext did not return")
+	}
+}
+
+func TestSerSlaveListenOnly(t *testing.T) {
+	resc := make(chan SerADU, 1)
+	p := &testSerPort{}
+	p.reply = func(res SerADU) []byte {
+		resc <- res
+		return nil
+	}
+	ss := newTestSerSlave(p, 0x01)
+	ss.Handler = testHandler{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ss.ServeContext(ctx)
+	if !p.WaitTimeout(0) {
+		t.Fatalf("Slave did not sync")
+	}
+
+	// send injects request r, and returns the response (nil if
+	// there is none). If r expects no response (want is false),
+	// send returns once the slave has stopped waiting for a
+	// response from another node, which it does only after
+	// processing r.
+	send := func(r Req, want bool) SerADU {
+		req, _ := SerPack(nil, 0x01, r)
+		p.Inject(req)
+		if !want {
+			p.WaitTimeout(p.Timeouts())
+			select {
+			case res := <-resc:
+				return res
+			default:
+				return nil
+			}
+		}
+		select {
+		case res := <-resc:
+			return res
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	diag := func(sub uint16, data ...uint16) *ReqResDiag {
+		return &ReqResDiag{Sub: sub, Data: data}
+	}
+
+	res := send(diag(DiagQueryData, 0x1234), true)
+	if res == nil || res.IsExc() {
+		t.Fatalf("Bad query-data response: %x", res)
+	}
+	// Multi-word query data: Sized by silence
+	req, _ := SerPack(nil, 0x01, diag(DiagQueryData, 1, 2, 3, 4))
+	res = send(diag(DiagQueryData, 1, 2, 3, 4), true)
+	if string(res) != string(req) {
+		t.Fatalf("Bad query-data echo: %x != %x", res, req)
+	}
+	if res := send(diag(DiagListenOnly, 0), false); res != nil {
+		t.Fatalf("Response to listen-only: %x", res)
+	}
+	if !ss.ListenOnly() {
+		t.Fatalf("Not in listen-only mode")
+	}
+	if res := send(&ReqResWrReg{Addr: 1, Val: 2}, false); res != nil {
+		t.Fatalf("Response in listen-only mode: %x", res)
+	}
+	if res := send(diag(DiagBusMsgCnt, 0), false); res != nil {
+		t.Fatalf("Response in listen-only mode: %x", res)
+	}
+	if n := ss.Counter(SlvCntSlvNoRes); n != 3 {
+		t.Fatalf("No-response count: %d", n)
+	}
+	// Restart, clearing the log: No response, since in
+	// listen-only mode.
+	if res := send(diag(DiagRestartComm, 0xff00), false); res != nil {
+		t.Fatalf("Response to restart: %x", res)
+	}
+	if ss.ListenOnly() {
+		t.Fatalf("Still in listen-only mode")
+	}
+	ev := ss.Events()
+	if len(ev) != 3 || ev[2] != SlvEvRestart ||
+		ev[1] != SlvEvRcv|SlvEvRcvListenOnly {
+		t.Fatalf("Bad event log: %x", ev)
+	}
+	res = send(diag(DiagSlvMsgCnt, 0), true)
+	if res == nil || res.IsExc() {
+		t.Fatalf("Bad counter response: %x", res)
+	}
+	var r ReqResDiag
+	if _, err := r.Unpack(res.PDU()); err != nil || r.Data[0] != 1 {
+		t.Fatalf("Bad message count: %+v, %v", r, err)
+	}
+	if res := send(&ReqResWrReg{Addr: 1, Val: 2}, true); res == nil {
+		t.Fatalf("No response after restart")
+	}
+}
+
+func TestSerSlaveListenOnlyAnyNode(t *testing.T) {
+	resc := make(chan SerADU, 1)
+	p := &testSerPort{}
+	p.reply = func(res SerADU) []byte {
+		resc <- res
+		return nil
+	}
+	ss := newTestSerSlave(p, 0x00)
+	ss.Handler = testHandler{}
+	ss.ForceListenOnly()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ss.ServeContext(ctx)
+	if !p.WaitTimeout(0) {
+		t.Fatalf("Slave did not sync")
+	}
+
+	req, _ := SerPack(nil, 0x05, &ReqResWrReg{Addr: 1, Val: 2})
+	p.Inject(req)
+	p.WaitTimeout(p.Timeouts())
+	select {
+	case res := <-resc:
+		t.Fatalf("Response in listen-only mode: %x", res)
+	default:
+	}
+	// Restart: No response, since in listen-only mode.
+	rst, _ := SerPack(nil, 0x05,
+		&ReqResDiag{Sub: DiagRestartComm, Data: []uint16{0}})
+	p.Inject(rst)
+	p.WaitTimeout(p.Timeouts())
+	if ss.ListenOnly() {
+		t.Fatalf("Still in listen-only mode")
+	}
+	p.Inject(req)
+	select {
+	case res := <-resc:
+		if string(res) != string(req) {
+			t.Fatalf("Bad response: %x", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No response after restart")
+	}
+}
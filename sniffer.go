@@ -0,0 +1,257 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"time"
+)
+
+// Default minimum silent interval considered a frame boundary by
+// SerSnifferRTU.
+const DflSerSnifGap = 20 * time.Millisecond
+
+// SerSnifferRTU is a SerReceiver for passive listeners (see Monitor)
+// of RTU-encoded buses. A passive listener cannot tell requests from
+// responses, and therefore cannot determine the size of the frames it
+// receives (see "rtu-timing.txt"). The sniffer tries both
+// interpretations for the bytes it receives: It sizes them as a
+// request and as a response, and keeps the interpretation whose CRC
+// validates. If both do, it prefers the one that ends at a silent
+// interval of at least Gap, and then the one that alternates with the
+// previous frame (a response after a request, and vice versa). While
+// the bytes still to come, or the silence after them, may tell the
+// two interpretations apart, the sniffer waits for them (for at most
+// FrameTimeout) before deciding. Bytes that cannot be the start of a
+// valid frame are discarded, so the sniffer can start receiving in
+// the middle of a busy bus, and quickly lock-on to the frames.
+//
+// Exported fields can be changed between calls to receiver methods.
+// All have reasonable defaults.
+type SerSnifferRTU struct {
+	// FrameTimeout is the intra-frame timeout. Silence for this
+	// long ends all frames that are being received.
+	FrameTimeout time.Duration
+	// Gap is the minimum silent interval considered a frame
+	// boundary (possibly). Candidate frames that would span such
+	// an interval are rejected. Gap should be longer than the
+	// silent intervals introduced inside frames by hardware
+	// buffering (FIFOs), and the O/S. Zero disables gap checks.
+	Gap time.Duration
+
+	r     DeadlineReader
+	p     []byte      // Pending (received, but not consumed) bytes
+	at    []time.Time // Reception times of pending bytes
+	idle  bool        // Line idle since the last pending byte
+	last  bool        // Last frame was a request
+	first time.Time
+	rbuf  [MaxSerADU]byte
+}
+
+// NewSerSnifferRTU returns a new sniffer for RTU-encoded ADUs.
+func NewSerSnifferRTU(r DeadlineReader) *SerSnifferRTU {
+	return &SerSnifferRTU{
+		r:            r,
+		FrameTimeout: DflSerSlvFrameTimeout,
+		Gap:          DflSerSnifGap,
+	}
+}
+
+// gapAt returns true if byte i of the pending bytes was preceded by a
+// silent interval of at least Gap, or if i is the end of the pending
+// bytes and the line is idle.
+func (s *SerSnifferRTU) gapAt(i int) bool {
+	if i >= len(s.p) {
+		return s.idle
+	}
+	return i > 0 && s.Gap > 0 && s.at[i].Sub(s.at[i-1]) >= s.Gap
+}
+
+// candidate checks if a frame of the given kind (request or response)
+// starts at the beginning of the pending bytes. It returns the frame
+// length and true if a complete, CRC-valid, frame is there; zero and
+// true if more bytes are needed to tell; and zero and false if such a
+// frame cannot be there.
+func (s *SerSnifferRTU) candidate(req bool) (int, bool) {
+	p := s.p
+	if p[0] > 247 {
+		return 0, false
+	}
+	l := frameLen(p, req)
+	if l == 0 {
+		return 0, false
+	}
+	if l < 0 && s.idle {
+		// No more bytes are coming
+		return 0, false
+	}
+	n := l
+	if l < 0 {
+		n = len(p)
+	}
+	for i := 1; i < n; i++ {
+		if s.gapAt(i) {
+			// Frames do not span gaps
+			return 0, false
+		}
+	}
+	if l < 0 {
+		return 0, true
+	}
+	if l < SerHeadSz+1+SerCRCSz || !SerADU(p[:l]).CheckCRC() {
+		return 0, false
+	}
+	return l, true
+}
+
+// undecided returns true if the two interpretations of the pending
+// bytes (as returned by candidate) may be told apart by the bytes
+// still to come, or by the silence after them: That is, if one is
+// complete and the other still possible, or if both are complete,
+// with different lengths, and it is not yet known if the longer one
+// ends at a gap.
+func (s *SerSnifferRTU) undecided(lq int, okq bool, ls int, oks bool) bool {
+	if (lq > 0 && ls == 0 && oks) || (ls > 0 && lq == 0 && okq) {
+		return true
+	}
+	if lq > 0 && ls > 0 && lq != ls {
+		l := lq
+		if ls > l {
+			l = ls
+		}
+		return l == len(s.p) && !s.idle
+	}
+	return false
+}
+
+// drop drops the first n pending bytes.
+func (s *SerSnifferRTU) drop(n int) {
+	s.p = s.p[:copy(s.p, s.p[n:])]
+	s.at = s.at[:copy(s.at, s.at[n:])]
+}
+
+// receive receives the next frame. If both interpretations for it are
+// equally likely, it is considered a request if prefer is true.
+func (s *SerSnifferRTU) receive(b []byte, deadline time.Time,
+	prefer bool) (SerADU, bool, error) {
+	skipped := false
+	for {
+		if len(s.p) > 0 {
+			lq, okq := s.candidate(true)
+			ls, oks := s.candidate(false)
+			if lq > 0 || ls > 0 {
+				if skipped {
+					// Report discarded bytes first
+					return b, false, ErrFrame
+				}
+				if !s.undecided(lq, okq, ls, oks) {
+					req := lq > 0
+					if lq > 0 && ls > 0 {
+						req = prefer
+						if gq, gs := s.gapAt(lq), s.gapAt(ls); gq != gs {
+							req = gq
+						}
+					}
+					l := ls
+					if req {
+						l = lq
+					}
+					b = appendBytes(b, s.p[:l])
+					s.first, s.last = s.at[0], req
+					s.drop(l)
+					return b, req, nil
+				}
+			} else if !okq && !oks {
+				// No frame starts here
+				s.drop(1)
+				skipped = true
+				continue
+			}
+		} else if skipped {
+			return b, false, ErrFrame
+		}
+		// Need more bytes
+		dl := deadline
+		if len(s.p) > 0 {
+			dl = time.Now().Add(s.FrameTimeout)
+		}
+		s.r.SetReadDeadline(dl)
+		n, err := s.r.Read(s.rbuf[:])
+		if n > 0 {
+			now := time.Now()
+			s.idle = false
+			s.p = append(s.p, s.rbuf[:n]...)
+			for i := 0; i < n; i++ {
+				s.at = append(s.at, now)
+			}
+			continue
+		}
+		if err != nil {
+			if !IsTimeout(err) {
+				return b, false, wErrIO(err)
+			}
+			if len(s.p) == 0 {
+				return b, false, ErrTimeout
+			}
+			// Pending frames cannot continue past silence
+			s.idle = true
+		}
+	}
+}
+
+// Receive receives the next frame (request or response) and appends
+// it to b. It returns the appended-to byte-slice as a SerADU, and true
+// if the frame is a request, false if it is a response. The first
+// byte of the frame must be received before the given deadline
+// expires. On error it returns b unaffected, along with the
+// error. The error returned can be ErrFrame (bytes that did not form
+// a valid frame were discarded), ErrTimeout, or any I/O error
+// returned by the DeadlineReader, wrapped in ErrIO. After an ErrFrame
+// error, the next call returns the next valid frame.
+func (s *SerSnifferRTU) Receive(b []byte,
+	deadline time.Time) (SerADU, bool, error) {
+	return s.receive(b, deadline, !s.last)
+}
+
+// ReceiveReq is like Receive, but does not return the kind of the
+// frame received, which may be a request or a response. If both
+// interpretations are equally likely, the frame is considered a
+// request.
+func (s *SerSnifferRTU) ReceiveReq(b []byte,
+	deadline time.Time) (SerADU, error) {
+	a, _, err := s.receive(b, deadline, true)
+	return a, err
+}
+
+// ReceiveRes is like ReceiveReq, but if both interpretations are
+// equally likely, the frame is considered a response.
+func (s *SerSnifferRTU) ReceiveRes(b []byte,
+	deadline time.Time) (SerADU, error) {
+	a, _, err := s.receive(b, deadline, false)
+	return a, err
+}
+
+// Buf returns nil. The sniffer has no buffer to receive frames in.
+func (s *SerSnifferRTU) Buf() []byte {
+	return nil
+}
+
+// FirstByte returns the time the first byte of the last frame was
+// received (approx.). Returns the zero time if no frame was received.
+func (s *SerSnifferRTU) FirstByte() time.Time {
+	return s.first
+}
+
+// Sync returns nil. The sniffer needs no synchronization, it
+// locks-on to the frames by itself.
+func (s *SerSnifferRTU) Sync() error {
+	return nil
+}
+
+// SyncContext returns ctx.Err(). See Sync.
+func (s *SerSnifferRTU) SyncContext(ctx context.Context) error {
+	return ctx.Err()
+}
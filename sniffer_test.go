@@ -0,0 +1,138 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSerSnifferRTU(t *testing.T) {
+	p := &testSerPort{}
+	s := NewSerSnifferRTU(p)
+	s.FrameTimeout = 10 * time.Millisecond
+	s.Gap = 5 * time.Millisecond
+
+	rcv := func(expReq bool, exp []byte) {
+		a, req, err := s.Receive(nil, time.Now().Add(100*time.Millisecond))
+		if err != nil {
+			t.Fatalf("Receive: %s", err)
+		}
+		if req != expReq || !bytes.Equal(a, exp) {
+			t.Fatalf("Received %v (req: %v), expected %v (req: %v)",
+				[]byte(a), req, exp, expReq)
+		}
+	}
+
+	// Join mid-stream: Garbage, then back-to-back request and
+	// response.
+	req := testPack(t, 1, &ReqRdRegs{Holding: true, Addr: 10, Num: 2})
+	res := testPack(t, 1, &ResRdRegs{Holding: true, Val: []uint16{1, 2}})
+	p.Inject([]byte{0x05, 0xff, 0x00})
+	p.Inject(req)
+	p.Inject(res)
+	if _, _, err := s.Receive(nil, time.Now().Add(100*time.Millisecond)); err != ErrFrame {
+		t.Fatalf("Expected ErrFrame, got: %v", err)
+	}
+	rcv(true, req)
+	rcv(false, res)
+
+	// Ambiguous frames (request and echo), resolved by alternation
+	wr := testPack(t, 2, &ReqResWrReg{Addr: 1, Val: 0x1234})
+	p.Inject(wr)
+	p.Inject(wr)
+	rcv(true, wr)
+	rcv(false, wr)
+
+	// Ambiguous frames of different lengths, resolved by gaps. amb
+	// is a response, whose first 8 bytes are also a valid request.
+	amb := testPack(t, 1, &ResRdRegs{Holding: true, Val: []uint16{0, 0x44}})
+	if frameLen(amb, true) != 8 || !SerADU(amb[:8]).CheckCRC() {
+		t.Fatalf("Not ambiguous: %x", amb)
+	}
+	// After a response, alternation prefers a request, but amb is
+	// followed by silence.
+	p.Inject(amb)
+	rcv(false, amb)
+	// After a request, alternation prefers a response, but the
+	// first 8 bytes of amb are followed by a gap, and then by a
+	// broadcast.
+	bc := testPack(t, 0, &ReqResWrReg{Addr: 1, Val: 2})
+	p.Inject(req)
+	rcv(true, req)
+	p.Inject(amb[:8])
+	time.AfterFunc(2*s.Gap, func() { p.Inject(bc) })
+	rcv(true, amb[:8])
+	rcv(false, bc)
+
+	if _, _, err := s.Receive(nil, time.Now().Add(10*time.Millisecond)); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got: %v", err)
+	}
+}
+
+func TestMonitorSniffer(t *testing.T) {
+	p := &testSerPort{}
+	s := NewSerSnifferRTU(p)
+	s.FrameTimeout = 10 * time.Millisecond
+	s.Gap = 5 * time.Millisecond
+	m := NewMonitor(s)
+	m.Timeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan Transaction)
+	done := make(chan error)
+	go func() { done <- m.Run(ctx, c) }()
+	next := func() Transaction {
+		select {
+		case tr := <-c:
+			return tr
+		case <-time.After(time.Second):
+			t.Fatalf("No transaction")
+		}
+		return Transaction{}
+	}
+
+	req := testPack(t, 1, &ReqRdRegs{Holding: true, Addr: 10, Num: 2})
+	res := testPack(t, 1, &ResRdRegs{Holding: true, Val: []uint16{1, 2}})
+	// Orphan response (monitor joined after the request), then a
+	// request with no response, then a complete transaction.
+	p.Inject(res)
+	p.Inject(req)
+	p.Inject(req)
+	p.Inject(res)
+	tr := next()
+	if tr.Err != ErrResponse || tr.ReqADU != nil || tr.Res == nil {
+		t.Fatalf("Bad orphan-response transaction: %+v", tr)
+	}
+	tr = next()
+	if tr.Err != ErrTimeout || tr.Req == nil || tr.ResADU != nil {
+		t.Fatalf("Bad timed-out transaction: %+v", tr)
+	}
+	tr = next()
+	if tr.Err != nil || tr.Req == nil || tr.Res == nil {
+		t.Fatalf("Bad transaction: %+v", tr)
+	}
+	// Garbage: The error is timed after the last transaction
+	p.Inject([]byte{0xff, 0xff})
+	last := tr
+	tr = next()
+	if tr.Err != ErrFrame || !tr.ReqTime.After(last.ResTime) {
+		t.Fatalf("Bad frame-error transaction: %+v (last: %+v)", tr, last)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Run did not return")
+	}
+}
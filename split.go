@@ -0,0 +1,231 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Maximum number of registers / bits that can be read or written with
+// a single request (so that requests and responses fit in MaxPDU).
+const (
+	MaxRdRegs = 125
+	MaxRdBits = 2000
+	MaxWrRegs = 123
+	MaxWrBits = 1968
+	// Registers written by a read-write-multiple-registers request
+	MaxRdWrRegs = 121
+)
+
+// Limits are the maximum number of registers or bits a device accepts
+// in a single request. Zero values mean "up to the spec maximum"
+// (MaxRdRegs, etc). Values larger than the spec maximum are clamped
+// down to it.
+type Limits struct {
+	RdRegs int
+	RdBits int
+	WrRegs int
+	WrBits int
+}
+
+// fix returns a copy of l with zero (or out of range) values replaced
+// by the spec maximums.
+func (l Limits) fix() Limits {
+	clamp := func(v, max int) int {
+		if v <= 0 || v > max {
+			return max
+		}
+		return v
+	}
+	l.RdRegs = clamp(l.RdRegs, MaxRdRegs)
+	l.RdBits = clamp(l.RdBits, MaxRdBits)
+	l.WrRegs = clamp(l.WrRegs, MaxWrRegs)
+	l.WrBits = clamp(l.WrBits, MaxWrBits)
+	return l
+}
+
+// ErrChunk is returned by the Splitter methods when one of the
+// requests (chunks) a read or write was split into fails.
+type ErrChunk struct {
+	// Addr and Num are the start address and the number of
+	// registers / bits of the failed chunk.
+	Addr uint16
+	Num  int
+	// Done is the number of registers / bits transferred
+	// successfully (by the previous chunks) before the failure.
+	Done int
+	// Err is the error the chunk failed with.
+	Err error
+}
+
+func (e *ErrChunk) Error() string {
+	return fmt.Sprintf("Chunk %d+%d failed (%d done): %s",
+		e.Addr, e.Num, e.Done, e.Err)
+}
+
+func (e *ErrChunk) Timeout() bool { return IsTimeout(e.Err) }
+
+func (e *ErrChunk) Temporary() bool { return IsTemporary(e.Err) }
+
+func (e *ErrChunk) Comm() bool { return IsComm(e.Err) }
+
+// Splitter reads and writes arbitrarily long ranges of registers or
+// bits (coils / discrete-inputs), by splitting them into as many
+// requests (chunks) as required, so that each request respects the
+// limits of the target device. Chunks are issued in order, using the
+// Doer (modbus master) given to NewSplitter. If a chunk fails, no
+// further chunks are issued, and an *ErrChunk error is returned,
+// along with the data read by the previous chunks (for reads).
+//
+// It is ok to call Splitter methods concurrently, as long as the
+// underlying Doer allows it (e.g. a SerBus).
+type Splitter struct {
+	// Dfl are the limits used for nodes without limits set by
+	// SetLimits.
+	Dfl Limits
+
+	d   Doer
+	mu  sync.Mutex
+	lim map[uint8]Limits
+}
+
+// NewSplitter returns a Splitter that issues requests using d.
+func NewSplitter(d Doer) *Splitter {
+	return &Splitter{d: d, lim: make(map[uint8]Limits)}
+}
+
+// SetLimits sets the limits for the given node.
+func (s *Splitter) SetLimits(node uint8, l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lim[node] = l
+}
+
+// limits returns the (fixed-up) limits for the given node.
+func (s *Splitter) limits(node uint8) Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.lim[node]
+	if !ok {
+		l = s.Dfl
+	}
+	return l.fix()
+}
+
+// checkRange checks that n items, starting at addr, fit in the
+// 16-bit address space.
+func checkRange(addr uint16, n int) error {
+	if n < 1 || int(addr)+n > 0x10000 {
+		return ErrRequest
+	}
+	return nil
+}
+
+// ReadRegs reads n holding (if holding == true) or input registers,
+// starting at addr. On error, it returns the registers read before
+// the failure (possibly none), along with the error.
+func (s *Splitter) ReadRegs(node uint8, holding bool,
+	addr uint16, n int) ([]uint16, error) {
+	if err := checkRange(addr, n); err != nil {
+		return nil, err
+	}
+	max := s.limits(node).RdRegs
+	val := make([]uint16, 0, n)
+	var res ResRdRegs
+	for len(val) < n {
+		a := addr + uint16(len(val))
+		c := n - len(val)
+		if c > max {
+			c = max
+		}
+		req := &ReqRdRegs{Holding: holding, Addr: a, Num: uint16(c)}
+		_, err := s.d.Do(node, req, &res)
+		if err == nil && len(res.Val) < c {
+			err = ErrResponse
+		}
+		if err != nil {
+			return val, &ErrChunk{Addr: a, Num: c, Done: len(val), Err: err}
+		}
+		val = append(val, res.Val[:c]...)
+	}
+	return val, nil
+}
+
+// ReadBits reads n coils (if coils == true) or discrete inputs,
+// starting at addr. On error, it returns the bits read before the
+// failure (possibly none), along with the error.
+func (s *Splitter) ReadBits(node uint8, coils bool,
+	addr uint16, n int) ([]bool, error) {
+	if err := checkRange(addr, n); err != nil {
+		return nil, err
+	}
+	max := s.limits(node).RdBits
+	val := make([]bool, 0, n)
+	var res ResRdInputs
+	for len(val) < n {
+		a := addr + uint16(len(val))
+		c := n - len(val)
+		if c > max {
+			c = max
+		}
+		req := &ReqRdInputs{Coils: coils, Addr: a, Num: uint16(c)}
+		_, err := s.d.Do(node, req, &res)
+		if err == nil && len(res.BitStat) < (c+7)/8 {
+			err = ErrResponse
+		}
+		if err != nil {
+			return val, &ErrChunk{Addr: a, Num: c, Done: len(val), Err: err}
+		}
+		val = append(val, unpackBits(res.BitStat, c)...)
+	}
+	return val, nil
+}
+
+// WriteRegs writes the values in v to len(v) holding registers,
+// starting at addr.
+func (s *Splitter) WriteRegs(node uint8, addr uint16, v []uint16) error {
+	if err := checkRange(addr, len(v)); err != nil {
+		return err
+	}
+	max := s.limits(node).WrRegs
+	for done := 0; done < len(v); {
+		a := addr + uint16(done)
+		c := len(v) - done
+		if c > max {
+			c = max
+		}
+		req := &ReqWrRegs{Addr: a, Val: v[done : done+c]}
+		if _, err := s.d.Do(node, req, nil); err != nil {
+			return &ErrChunk{Addr: a, Num: c, Done: done, Err: err}
+		}
+		done += c
+	}
+	return nil
+}
+
+// WriteCoils writes the values in v to len(v) coils, starting at
+// addr.
+func (s *Splitter) WriteCoils(node uint8, addr uint16, v []bool) error {
+	if err := checkRange(addr, len(v)); err != nil {
+		return err
+	}
+	max := s.limits(node).WrBits
+	for done := 0; done < len(v); {
+		a := addr + uint16(done)
+		c := len(v) - done
+		if c > max {
+			c = max
+		}
+		req := &ReqWrCoils{Addr: a, Num: uint16(c),
+			BitStat: packBits(v[done : done+c])}
+		if _, err := s.d.Do(node, req, nil); err != nil {
+			return &ErrChunk{Addr: a, Num: c, Done: done, Err: err}
+		}
+		done += c
+	}
+	return nil
+}
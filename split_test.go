@@ -0,0 +1,103 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"reflect"
+	"testing"
+)
+
+// failDoer passes requests to Doer d, but fails request number fail
+// (zero-based) with error err.
+type failDoer struct {
+	d    Doer
+	n    int
+	fail int
+	err  error
+}
+
+func (f *failDoer) Do(node uint8, req Req, res Res) (Res, error) {
+	n := f.n
+	f.n++
+	if n == f.fail {
+		return nil, f.err
+	}
+	return f.d.Do(node, req, res)
+}
+
+func TestSplitterRegs(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: dev.reply}
+	s := NewSplitter(newTestSerMaster(p))
+	s.SetLimits(0x01, Limits{RdRegs: 100, WrRegs: 50})
+
+	v := make([]uint16, 300)
+	for i := range v {
+		v[i] = uint16(i * 3)
+	}
+	if err := s.WriteRegs(0x01, 1000, v); err != nil {
+		t.Fatalf("WriteRegs: %s", err)
+	}
+	if len(dev.reqs) != 6 {
+		t.Fatalf("WriteRegs: %d requests != 6", len(dev.reqs))
+	}
+	r, err := s.ReadRegs(0x01, true, 1000, len(v))
+	if err != nil {
+		t.Fatalf("ReadRegs: %s", err)
+	}
+	if len(dev.reqs) != 9 {
+		t.Fatalf("ReadRegs: %d requests != 3", len(dev.reqs)-6)
+	}
+	if !reflect.DeepEqual(r, v) {
+		t.Fatalf("ReadRegs: Data mismatch")
+	}
+
+	// Fail the second chunk
+	s.d = &failDoer{d: s.d, fail: 1, err: ErrTimeout}
+	r, err = s.ReadRegs(0x01, true, 1000, len(v))
+	ec, ok := err.(*ErrChunk)
+	if !ok {
+		t.Fatalf("ReadRegs: Expected *ErrChunk, got: %v", err)
+	}
+	if ec.Addr != 1100 || ec.Num != 100 || ec.Done != 100 ||
+		ec.Err != ErrTimeout || !IsTimeout(err) {
+		t.Fatalf("ReadRegs: Bad error: %+v", ec)
+	}
+	if !reflect.DeepEqual(r, v[:100]) {
+		t.Fatalf("ReadRegs: Bad partial data")
+	}
+
+	if _, err := s.ReadRegs(0x01, true, 0xffff, 2); err != ErrRequest {
+		t.Fatalf("ReadRegs: Expected ErrRequest, got: %v", err)
+	}
+}
+
+func TestSplitterBits(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: dev.reply}
+	s := NewSplitter(newTestSerMaster(p))
+
+	v := make([]bool, 5000)
+	for i := range v {
+		v[i] = i%3 == 0
+	}
+	if err := s.WriteCoils(0x01, 7, v); err != nil {
+		t.Fatalf("WriteCoils: %s", err)
+	}
+	if len(dev.reqs) != 3 {
+		t.Fatalf("WriteCoils: %d requests != 3", len(dev.reqs))
+	}
+	r, err := s.ReadBits(0x01, true, 7, len(v))
+	if err != nil {
+		t.Fatalf("ReadBits: %s", err)
+	}
+	if len(dev.reqs) != 6 {
+		t.Fatalf("ReadBits: %d requests != 3", len(dev.reqs)-3)
+	}
+	if !reflect.DeepEqual(r, v) {
+		t.Fatalf("ReadBits: Data mismatch")
+	}
+}
@@ -38,3 +38,18 @@ func (a TcpADU) SetLen(l uint16) {
 	a[4] = byte(l >> 8)
 	a[5] = byte(l)
 }
+
+// TcpPack packs (marshals) a modbus-over-TCP request or response ADU
+// and appends it to slice "b". It is ok if "b" is nil. Returns the
+// appended-to slice as TcpADU, or error. On error "b" is returned
+// unaffected.
+func TcpPack(b []byte, trans uint16, unit uint8, rr ReqRes) (TcpADU, error) {
+	b1 := append(b, byte(trans>>8), byte(trans), 0, 0, 0, 0, unit)
+	b1, err := rr.Pack(b1)
+	if err != nil {
+		return b, err
+	}
+	a := TcpADU(b1[len(b):])
+	a.SetLen(uint16(len(a) - TcpHeadSz + 1))
+	return b1, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"io"
+	"time"
+)
+
+// ModBus over TCP default parameters
+const (
+	// For masters
+	DflTcpMstTimeout     = 1 * time.Second
+	DflTcpMstConnTimeout = 5 * time.Second
+	DflTcpMstBackoffMin  = 100 * time.Millisecond
+	DflTcpMstBackoffMax  = 30 * time.Second
+	DflTcpMstPoolSize    = 1
+	// Common
+	DflTcpWrTimeout = 2 * time.Second
+)
+
+// TcpReceive receives a modbus-over-TCP ADU (request or response)
+// from r. It appends the received ADU at byte-slice b. It is ok for b
+// to be nil. The first byte of the ADU must be received before the
+// given deadline expires. Returns the appended-to byte-slice as a
+// TcpADU. On error it returns b unaffected, along with the error.
+//
+// The error returned can be one of the following: ErrTimeout (no
+// part of the ADU received before the deadline), ErrFrame (bad MBAP
+// header, or ADU partially received), or any I/O error returned by
+// the DeadlineReader, wrapped in ErrIO. After ErrFrame or ErrIO the
+// stream cannot be trusted to be aligned at an ADU boundary, and the
+// connection should be closed.
+func TcpReceive(r DeadlineReader, b []byte, deadline time.Time) (TcpADU, error) {
+	var buf [MaxTcpADU]byte
+
+	r.SetReadDeadline(deadline)
+	n, err := io.ReadFull(r, buf[:TcpHeadSz])
+	if err != nil {
+		if n == 0 && IsTimeout(err) {
+			return b, ErrTimeout
+		}
+		if err == io.ErrUnexpectedEOF || IsTimeout(err) {
+			return b, ErrFrame
+		}
+		return b, wErrIO(err)
+	}
+	a := TcpADU(buf[:TcpHeadSz])
+	l := int(a.Len())
+	if a.Proto() != 0 || l < 2 || l+TcpHeadSz-1 > MaxTcpADU {
+		return b, ErrFrame
+	}
+	_, err = io.ReadFull(r, buf[TcpHeadSz:TcpHeadSz+l-1])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF ||
+			IsTimeout(err) {
+			return b, ErrFrame
+		}
+		return b, wErrIO(err)
+	}
+	b = append(b, buf[:TcpHeadSz+l-1]...)
+	return b, nil
+}
+
+// TcpTransmit transmits the modbus-over-TCP ADU a to w. The ADU must
+// be written completely before the given deadline expires. Returns
+// nil, or any I/O error returned by the DeadlineWriter, wrapped in
+// ErrIO.
+func TcpTransmit(w DeadlineWriter, a TcpADU, deadline time.Time) error {
+	w.SetWriteDeadline(deadline)
+	_, err := w.Write(a)
+	if err != nil {
+		return wErrIO(err)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// TcpMaster is a modbus-over-TCP master (client) for a single
+// endpoint (server address). It keeps a small pool of connections to
+// the endpoint, which are established on demand, and are used to
+// issue requests concurrently (one outstanding request per
+// connection). Broken connections are detected and closed, and new
+// ones are dialed when required, observing an exponential backoff
+// between failed dial attempts. It is ok to call TcpMaster methods
+// concurrently from multiple goroutines.
+//
+// Exported fields can be changed between calls to master methods,
+// though not while other goroutines are using the master. All have
+// reasonable defaults.
+type TcpMaster struct {
+	// Addr is the address (host:port) of the endpoint.
+	Addr string
+	// Dial is the function used to establish connections to the
+	// endpoint. If nil, connections are established using
+	// net.DialTimeout("tcp", Addr, ConnTimeout).
+	Dial func(addr string) (net.Conn, error)
+	// Response timeout. Counting from the end of the request
+	// transmission, until the reception of the response.
+	Timeout time.Duration
+	// Timeout for establishing connections.
+	ConnTimeout time.Duration
+	// Minimum and maximum delay between successive failed dial
+	// attempts. After each failure the delay is doubled, starting
+	// from BackoffMin, and up to BackoffMax.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+	// Maximum number of connections in the pool.
+	PoolSize int
+	// Lenient disables the validation of responses against
+	// requests (see SerMaster.Lenient).
+	Lenient bool
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	idle    []net.Conn
+	nconn   int
+	trans   uint16
+	fails   uint
+	retryAt time.Time
+	closed  bool
+}
+
+// NewTcpMaster returns a modbus-over-TCP master (client) for the
+// endpoint at addr (host:port).
+func NewTcpMaster(addr string) *TcpMaster {
+	tm := &TcpMaster{
+		Addr:        addr,
+		Timeout:     DflTcpMstTimeout,
+		ConnTimeout: DflTcpMstConnTimeout,
+		BackoffMin:  DflTcpMstBackoffMin,
+		BackoffMax:  DflTcpMstBackoffMax,
+		PoolSize:    DflTcpMstPoolSize,
+	}
+	tm.cond.L = &tm.mu
+	return tm
+}
+
+// backoff returns the delay before the next dial attempt, after n
+// consecutive failures.
+func (tm *TcpMaster) backoff(n uint) time.Duration {
+	d := tm.BackoffMin
+	for ; n > 1 && d < tm.BackoffMax; n-- {
+		d *= 2
+	}
+	if d > tm.BackoffMax {
+		d = tm.BackoffMax
+	}
+	return d
+}
+
+// get returns a connection from the pool, or dials a new one if the
+// pool is not full. If the pool is full, it waits for a connection
+// to be returned. While in backoff (after a failed dial attempt) it
+// returns ErrNoConn.
+func (tm *TcpMaster) get() (net.Conn, error) {
+	tm.mu.Lock()
+	for {
+		if tm.closed {
+			tm.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if n := len(tm.idle); n > 0 {
+			c := tm.idle[n-1]
+			tm.idle = tm.idle[:n-1]
+			tm.mu.Unlock()
+			return c, nil
+		}
+		if tm.nconn < tm.PoolSize || tm.nconn == 0 {
+			break
+		}
+		tm.cond.Wait()
+	}
+	if time.Now().Before(tm.retryAt) {
+		tm.mu.Unlock()
+		return nil, ErrNoConn
+	}
+	tm.nconn++
+	tm.mu.Unlock()
+
+	var c net.Conn
+	var err error
+	if tm.Dial != nil {
+		c, err = tm.Dial(tm.Addr)
+	} else {
+		c, err = net.DialTimeout("tcp", tm.Addr, tm.ConnTimeout)
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if err != nil {
+		tm.nconn--
+		tm.fails++
+		tm.retryAt = time.Now().Add(tm.backoff(tm.fails))
+		tm.cond.Broadcast()
+		return nil, ErrNoConn
+	}
+	tm.fails = 0
+	tm.retryAt = time.Time{}
+	return c, nil
+}
+
+// put returns connection c to the pool. If broken is true the
+// connection is closed, and so are all idle connections in the pool
+// (since they are to the same endpoint, they are most likely broken
+// as well).
+func (tm *TcpMaster) put(c net.Conn, broken bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if broken || tm.closed {
+		c.Close()
+		tm.nconn--
+		if broken {
+			for _, ci := range tm.idle {
+				ci.Close()
+				tm.nconn--
+			}
+			tm.idle = tm.idle[:0]
+		}
+	} else {
+		tm.idle = append(tm.idle, c)
+	}
+	tm.cond.Broadcast()
+}
+
+func (tm *TcpMaster) nextTrans() uint16 {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.trans++
+	return tm.trans
+}
+
+// SndRcv transmits the request ADU and receives a response ADU. The
+// transaction-id of the request is set by SndRcv (req is modified
+// in-place). The response ADU is appended to byte-slice b. It is ok
+// for b to be nil. Returns the appended-to byte-slice as a TcpADU. On
+// error it returns b unaffected, along with the error. Exception
+// responses by the server are not considered errors.
+//
+// Responses with a transaction-id or a unit-id not matching the
+// request's (e.g. late responses to previous, timed-out, requests)
+// are silently discarded.
+//
+// Errors returned by SndRcv are: ErrTimeout (response reception
+// timeout), ErrConnLost (the connection broke while the request was
+// outstanding), ErrNoConn (no connection to the endpoint could be
+// established, waiting before trying again), and ErrClosed (the
+// master was closed). Of these, ErrTimeout, ErrConnLost, and ErrNoConn
+// test true with IsTemporary(); the request can be retried later.
+func (tm *TcpMaster) SndRcv(req TcpADU, b []byte) (TcpADU, error) {
+	return tm.SndRcvContext(context.Background(), req, b)
+}
+
+// SndRcvContext is like SndRcv, but honors the cancellation and the
+// deadline of ctx. The response reception deadline is not allowed to
+// extend beyond the context's deadline, and the request is not
+// transmitted if the context is done. Cancellation of a request
+// already transmitted takes effect when its response timeout
+// expires. If the context is done, SndRcvContext returns ctx.Err().
+func (tm *TcpMaster) SndRcvContext(ctx context.Context,
+	req TcpADU, b []byte) (TcpADU, error) {
+	if err := ctx.Err(); err != nil {
+		return b, err
+	}
+	c, err := tm.get()
+	if err != nil {
+		return b, err
+	}
+	if err = ctx.Err(); err != nil {
+		tm.put(c, false)
+		return b, err
+	}
+	req.SetTrans(tm.nextTrans())
+	err = TcpTransmit(c, req, time.Now().Add(DflTcpWrTimeout))
+	if err != nil {
+		tm.put(c, true)
+		return b, ErrConnLost
+	}
+	deadline := time.Now().Add(tm.Timeout)
+	capped := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+		capped = true
+	}
+	for {
+		var a TcpADU
+		a, err = TcpReceive(c, b, deadline)
+		if err != nil {
+			if err == ErrTimeout {
+				tm.put(c, false)
+				if capped || ctx.Err() != nil {
+					if err = ctx.Err(); err == nil {
+						err = context.DeadlineExceeded
+					}
+				}
+				return b, err
+			}
+			// ErrFrame or ErrIO
+			tm.put(c, true)
+			return b, ErrConnLost
+		}
+		a = a[len(b):]
+		if a.Trans() != req.Trans() || a.Unit() != req.Unit() {
+			// Stale response, discard
+			continue
+		}
+		tm.put(c, false)
+		return append(b, a...), nil
+	}
+}
+
+// Do packs and transmits request req to the unit with the given
+// unit-id, receives a response, and unpacks it in res. If res is nil,
+// a propper response type is allocated. Do returns the unpacked
+// response. On error it returns nil and the error. Exception
+// responses by the server are considered, and returned as, errors
+// (ResExc implements the error interface).
+//
+// Appart from exception responses, errors returned by Do are:
+// ErrRequest (bad request), ErrResponse or *ErrMismatch (bad or
+// invalid response, see IsBadResponse), and any error returned by
+// SndRcv.
+func (tm *TcpMaster) Do(unit uint8, req Req, res Res) (Res, error) {
+	return tm.DoContext(context.Background(), unit, req, res)
+}
+
+// DoContext is like Do, but honors the cancellation and the deadline
+// of ctx. See SndRcvContext for details.
+func (tm *TcpMaster) DoContext(ctx context.Context,
+	unit uint8, req Req, res Res) (Res, error) {
+	var rb [MaxTcpADU]byte
+	a, err := TcpPack(nil, 0, unit, req)
+	if err != nil {
+		return nil, ErrRequest
+	}
+	a, err = tm.SndRcvContext(ctx, a, rb[:0])
+	if err != nil {
+		return nil, err
+	}
+	res, err = unpackRes(a.PDU(), req.FnCode(), res)
+	if err == nil && !tm.Lenient {
+		if err := validateRes(req, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, err
+}
+
+// Close closes the master and all the connections in the pool.
+// Requests waiting for a connection fail with ErrClosed. Connections
+// with requests outstanding are closed when the requests complete.
+func (tm *TcpMaster) Close() error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.closed = true
+	for _, c := range tm.idle {
+		c.Close()
+		tm.nconn--
+	}
+	tm.idle = nil
+	tm.cond.Broadcast()
+	return nil
+}
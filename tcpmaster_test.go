@@ -0,0 +1,117 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpEcho serves n requests on c, echoing them back as responses,
+// and then closes c.
+func tcpEcho(c net.Conn, n int) {
+	defer c.Close()
+	for i := 0; i < n; i++ {
+		a, err := TcpReceive(c, nil, time.Now().Add(time.Second))
+		if err != nil {
+			return
+		}
+		if TcpTransmit(c, a, time.Now().Add(time.Second)) != nil {
+			return
+		}
+	}
+}
+
+func TestTcpMasterReconnect(t *testing.T) {
+	var dials int
+	refuse := false
+	tm := NewTcpMaster("test")
+	tm.BackoffMin = 50 * time.Millisecond
+	tm.Dial = func(addr string) (net.Conn, error) {
+		dials++
+		if refuse {
+			return nil, errors.New("connection refused")
+		}
+		c, s := net.Pipe()
+		go tcpEcho(s, 1)
+		return c, nil
+	}
+	defer tm.Close()
+
+	req := &ReqResWrReg{Addr: 0x10, Val: 0xbeef}
+	res, err := tm.Do(0x01, req, nil)
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if r, ok := res.(*ReqResWrReg); !ok || *r != *req {
+		t.Fatalf("Bad response: %+v", res)
+	}
+	// Server closed the connection after the first request
+	_, err = tm.Do(0x01, req, nil)
+	if err != ErrConnLost || !IsTemporary(err) {
+		t.Fatalf("Expected temporary ErrConnLost, got: %v", err)
+	}
+	// Reconnect
+	_, err = tm.Do(0x01, req, nil)
+	if err != nil {
+		t.Fatalf("Do after reconnect: %s", err)
+	}
+	if dials != 2 {
+		t.Fatalf("Bad number of dials: %d != 2", dials)
+	}
+	// Fail dialing, check backoff
+	refuse = true
+	_, err = tm.Do(0x01, req, nil)
+	if err != ErrConnLost {
+		t.Fatalf("Expected ErrConnLost, got: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err = tm.Do(0x01, req, nil)
+		if err != ErrNoConn || !IsTemporary(err) {
+			t.Fatalf("Expected temporary ErrNoConn, got: %v", err)
+		}
+	}
+	if dials != 3 {
+		t.Fatalf("Dialed while in backoff: %d != 3", dials)
+	}
+	time.Sleep(tm.BackoffMin)
+	refuse = false
+	_, err = tm.Do(0x01, req, nil)
+	if err != nil {
+		t.Fatalf("Do after backoff: %s", err)
+	}
+}
+
+func TestTcpMasterStale(t *testing.T) {
+	c, s := net.Pipe()
+	tm := NewTcpMaster("test")
+	tm.Dial = func(addr string) (net.Conn, error) { return c, nil }
+	defer tm.Close()
+	go func() {
+		a, err := TcpReceive(s, nil, time.Now().Add(time.Second))
+		if err != nil {
+			return
+		}
+		// Response with wrong transaction-id, then the right one
+		stale := append(TcpADU(nil), a...)
+		stale.SetTrans(a.Trans() - 1)
+		TcpTransmit(s, stale, time.Now().Add(time.Second))
+		TcpTransmit(s, a, time.Now().Add(time.Second))
+	}()
+	a, err := TcpPack(nil, 0, 0x01, &ReqResWrCoil{Addr: 1, Status: true})
+	if err != nil {
+		t.Fatalf("Cannot pack: %s", err)
+	}
+	r, err := tm.SndRcv(a, nil)
+	if err != nil {
+		t.Fatalf("SndRcv: %s", err)
+	}
+	if r.Trans() != a.Trans() {
+		t.Fatalf("Bad transaction-id: %d != %d", r.Trans(), a.Trans())
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import "fmt"
+
+// ErrMismatch is returned by masters when a response does not answer
+// the request it was received for (e.g. it comes from another node,
+// or echoes a different address). ErrMismatch is a more descriptive
+// form of ErrResponse; use IsBadResponse to test for either.
+type ErrMismatch struct {
+	// Function code of the request
+	Fn FnCode
+	// Description of the mismatch
+	Msg string
+}
+
+func (e *ErrMismatch) Error() string {
+	return fmt.Sprintf("%s (%s: %s)", ErrResponse, e.Fn, e.Msg)
+}
+
+// Unwrap returns ErrResponse.
+func (e *ErrMismatch) Unwrap() error { return ErrResponse }
+
+// IsBadResponse tests if error is ErrResponse, or an *ErrMismatch.
+func IsBadResponse(e error) bool {
+	if e == ErrResponse {
+		return true
+	}
+	_, ok := e.(*ErrMismatch)
+	return ok
+}
+
+func mismatch(fn FnCode, format string, args ...interface{}) error {
+	return &ErrMismatch{Fn: fn, Msg: fmt.Sprintf(format, args...)}
+}
+
+// validateRes checks that (non-exception) response res answers
+// request req. It returns nil if it does, or if it cannot tell (e.g.
+// for unknown request types), and an *ErrMismatch if it does not.
+func validateRes(req Req, res Res) error {
+	fn := req.FnCode()
+	if res.FnCode() != fn {
+		return mismatch(fn, "function code %s", res.FnCode())
+	}
+	switch q := req.(type) {
+	case *ReqRdInputs:
+		r, ok := res.(*ResRdInputs)
+		if !ok {
+			break
+		}
+		if exp := (int(q.Num) + 7) / 8; len(r.BitStat) != exp {
+			return mismatch(fn, "byte count %d, expected %d",
+				len(r.BitStat), exp)
+		}
+	case *ReqRdRegs:
+		r, ok := res.(*ResRdRegs)
+		if !ok {
+			break
+		}
+		if len(r.Val) != int(q.Num) {
+			return mismatch(fn, "%d registers, expected %d",
+				len(r.Val), q.Num)
+		}
+	case *ReqResWrCoil:
+		r, ok := res.(*ReqResWrCoil)
+		if !ok {
+			break
+		}
+		if r.Addr != q.Addr || r.Status != q.Status {
+			return mismatch(fn, "echo %d=%v, expected %d=%v",
+				r.Addr, r.Status, q.Addr, q.Status)
+		}
+	case *ReqResWrReg:
+		r, ok := res.(*ReqResWrReg)
+		if !ok {
+			break
+		}
+		if r.Addr != q.Addr || r.Val != q.Val {
+			return mismatch(fn, "echo %d=%#04x, expected %d=%#04x",
+				r.Addr, r.Val, q.Addr, q.Val)
+		}
+	case *ReqResMskWrReg:
+		r, ok := res.(*ReqResMskWrReg)
+		if !ok {
+			break
+		}
+		if r.Addr != q.Addr || r.AndMsk != q.AndMsk || r.OrMsk != q.OrMsk {
+			return mismatch(fn, "echo does not match request")
+		}
+	case *ReqWrCoils:
+		r, ok := res.(*ResWrCoils)
+		if !ok {
+			break
+		}
+		if r.Addr != q.Addr || r.Num != q.Num {
+			return mismatch(fn, "addr/num %d/%d, expected %d/%d",
+				r.Addr, r.Num, q.Addr, q.Num)
+		}
+	case *ReqWrRegs:
+		r, ok := res.(*ResWrRegs)
+		if !ok {
+			break
+		}
+		if r.Addr != q.Addr || int(r.Num) != len(q.Val) {
+			return mismatch(fn, "addr/num %d/%d, expected %d/%d",
+				r.Addr, r.Num, q.Addr, len(q.Val))
+		}
+	case *ReqRdWrRegs:
+		r, ok := res.(*ResRdWrRegs)
+		if !ok {
+			break
+		}
+		if len(r.Val) != int(q.RdNum) {
+			return mismatch(fn, "%d registers, expected %d",
+				len(r.Val), q.RdNum)
+		}
+	case *ReqResDiag:
+		r, ok := res.(*ReqResDiag)
+		if !ok {
+			break
+		}
+		if r.Sub != q.Sub {
+			return mismatch(fn, "sub-function %#04x, expected %#04x",
+				r.Sub, q.Sub)
+		}
+	case *ReqRdDevId:
+		r, ok := res.(*ResRdDevId)
+		if !ok {
+			break
+		}
+		if r.Code != q.Code {
+			return mismatch(fn, "read-device-id code %d, expected %d",
+				r.Code, q.Code)
+		}
+	}
+	return nil
+}
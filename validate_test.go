@@ -0,0 +1,97 @@
+// Copyright (c) 2015, Nick Patavalis (npat@efault.net).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE file.
+
+package modbus
+
+import "testing"
+
+func TestValidateRes(t *testing.T) {
+	tests := []struct {
+		req Req
+		res Res
+		ok  bool
+	}{
+		{&ReqRdRegs{Num: 2}, &ResRdRegs{Val: []uint16{1, 2}}, true},
+		{&ReqRdRegs{Num: 2}, &ResRdRegs{Val: []uint16{1}}, false},
+		{&ReqRdInputs{Num: 9}, &ResRdInputs{BitStat: []byte{0, 1}}, true},
+		{&ReqRdInputs{Num: 9}, &ResRdInputs{BitStat: []byte{0}}, false},
+		{&ReqResWrReg{Addr: 1, Val: 2}, &ReqResWrReg{Addr: 1, Val: 2}, true},
+		{&ReqResWrReg{Addr: 1, Val: 2}, &ReqResWrReg{Addr: 1, Val: 3}, false},
+		{&ReqResWrCoil{Addr: 1, Status: true},
+			&ReqResWrCoil{Addr: 2, Status: true}, false},
+		{&ReqWrCoils{Addr: 5, Num: 3}, &ResWrCoils{Addr: 5, Num: 3}, true},
+		{&ReqWrCoils{Addr: 5, Num: 3}, &ResWrCoils{Addr: 5, Num: 2}, false},
+		{&ReqWrRegs{Addr: 5, Val: []uint16{1, 2}},
+			&ResWrRegs{Addr: 5, Num: 2}, true},
+		{&ReqWrRegs{Addr: 5, Val: []uint16{1, 2}},
+			&ResWrRegs{Addr: 6, Num: 2}, false},
+		{&ReqRdWrRegs{RdNum: 1}, &ResRdWrRegs{Val: []uint16{1, 2}}, false},
+		{&ReqRdRegs{Num: 1}, &ResWrRegs{}, false},
+	}
+	for i, tst := range tests {
+		err := validateRes(tst.req, tst.res)
+		if (err == nil) != tst.ok {
+			t.Fatalf("%d: Unexpected result: %v", i, err)
+		}
+		if err != nil && !IsBadResponse(err) {
+			t.Fatalf("%d: Not a bad-response error: %v", i, err)
+		}
+	}
+}
+
+func TestSerMasterValidate(t *testing.T) {
+	dev := &testDev{node: 0x01}
+	p := &testSerPort{reply: func(a SerADU) []byte {
+		switch a.Node() {
+		case 0x01:
+			// Buggy: echoes the wrong value
+			r := dev.reply(a)
+			if r != nil && a.FnCode() == WrReg {
+				r[5] ^= 0x01
+				r = SerAddCRC(r[:len(r)-2])
+			}
+			return r
+		case 0x02:
+			// Replies as node 3
+			r, _ := SerPack(nil, 0x03,
+				&ResRdRegs{Holding: true, Val: []uint16{0}})
+			return r
+		}
+		return nil
+	}}
+	sm := newTestSerMaster(p)
+	wr := &ReqResWrReg{Addr: 1, Val: 0x10}
+	rd := &ReqRdRegs{Holding: true, Num: 1}
+
+	if _, err := sm.Do(0x01, rd, nil); err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	_, err := sm.Do(0x01, wr, nil)
+	if _, ok := err.(*ErrMismatch); !ok {
+		t.Fatalf("Expected ErrMismatch, got: %v", err)
+	}
+	_, err = sm.Do(0x02, rd, nil)
+	if _, ok := err.(*ErrMismatch); !ok {
+		t.Fatalf("Expected ErrMismatch, got: %v", err)
+	}
+	st := sm.NodeStats(0x01)
+	if st.Cnt[MstCntRes] != 2 || st.Cnt[MstCntMismatch] != 1 {
+		t.Fatalf("Bad stats for node 1: %+v", st)
+	}
+	st = sm.NodeStats(0x02)
+	if st.Cnt[MstCntRes] != 0 || st.Cnt[MstCntMismatch] != 1 ||
+		st.Latency.N != 0 {
+		t.Fatalf("Bad stats for node 2: %+v", st)
+	}
+
+	sm.SetNodeLenient(0x01, true)
+	if _, err := sm.Do(0x01, wr, nil); err != nil {
+		t.Fatalf("Lenient Do: %s", err)
+	}
+	sm.Lenient = true
+	if _, err := sm.Do(0x02, rd, nil); err != nil {
+		t.Fatalf("Lenient Do: %s", err)
+	}
+}